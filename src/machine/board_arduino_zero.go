@@ -90,7 +90,9 @@ const (
 const (
 	usb_STRING_PRODUCT      = "Arduino Zero"
 	usb_STRING_MANUFACTURER = "Arduino LLC"
+)
 
+var (
 	usb_VID uint16 = 0x2341
 	usb_PID uint16 = 0x804d
 )
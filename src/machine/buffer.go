@@ -12,6 +12,7 @@ type RingBuffer struct {
 	rxbuffer [bufferSize]volatile.Register8
 	head     volatile.Register8
 	tail     volatile.Register8
+	dropped  volatile.Register8 // bytes dropped by Put, wraps around
 }
 
 // NewRingBuffer returns a new ring buffer.
@@ -32,6 +33,7 @@ func (rb *RingBuffer) Put(val byte) bool {
 		rb.rxbuffer[rb.head.Get()%bufferSize].Set(val)
 		return true
 	}
+	rb.dropped.Set(rb.dropped.Get() + 1)
 	return false
 }
 
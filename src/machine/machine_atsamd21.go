@@ -1743,6 +1743,7 @@ type USBCDC struct {
 	waitTxcRetryCount uint8
 	sent              bool
 	configured        bool
+	rxPending         bool
 }
 
 var (
@@ -1864,6 +1865,8 @@ const (
 	usb_DEVICE_PCKSIZE_SIZE_Pos  = 28
 	usb_DEVICE_PCKSIZE_SIZE_Mask = 0x7
 
+	usb_DEVICE_PCKSIZE_AUTO_ZLP = 1 << 31
+
 	usb_DEVICE_PCKSIZE_MULTI_PACKET_SIZE_Pos  = 14
 	usb_DEVICE_PCKSIZE_MULTI_PACKET_SIZE_Mask = 0x3FFF
 )
@@ -1874,7 +1877,6 @@ var (
 	udd_ep_in_cache_buffer  [7][128]uint8
 	udd_ep_out_cache_buffer [7][128]uint8
 
-	isEndpointHalt        = false
 	isRemoteWakeUpEnabled = false
 	endPoints             = []uint32{usb_ENDPOINT_TYPE_CONTROL,
 		(usb_ENDPOINT_TYPE_INTERRUPT | usbEndpointIn),
@@ -1882,8 +1884,15 @@ var (
 		(usb_ENDPOINT_TYPE_BULK | usbEndpointIn)}
 
 	usbConfiguration uint8
-	usbSetInterface  uint8
 	usbLineInfo      = cdcLineInfo{115200, 0x00, 0x00, 0x08, 0x00}
+
+	// CDC ACM notification queued by sendCDCNotification while the previous
+	// one is still waiting for the host
+	cdcNotification struct {
+		data    [cdcSerialStateSize]byte
+		length  int
+		pending bool
+	}
 )
 
 // Configure the USB CDC interface. The config is here for compatibility with the UART interface.
@@ -1918,6 +1927,9 @@ func (usbcdc *USBCDC) Configure(config UARTConfig) {
 	// enable interrupt for start of frame
 	sam.USB_DEVICE.INTENSET.SetBits(sam.USB_DEVICE_INTENSET_SOF)
 
+	// enable interrupts for suspend and resume
+	sam.USB_DEVICE.INTENSET.SetBits(sam.USB_DEVICE_INTENSET_SUSPEND | sam.USB_DEVICE_INTENSET_WAKEUP | sam.USB_DEVICE_INTENSET_EORSM)
+
 	// enable USB
 	sam.USB_DEVICE.CTRLA.SetBits(sam.USB_DEVICE_CTRLA_ENABLE)
 
@@ -1990,15 +2002,30 @@ func handleUSB(intr interrupt.Interrupt) {
 		setEPINTENSET(0, sam.USB_DEVICE_EPINTENSET_RXSTP)
 
 		usbConfiguration = 0
+		clearEndpointHalts()
+		isRemoteWakeUpEnabled = false
+		usbSuspended = false
+		setUSBState(USBStateDefault)
 
 		// ack the End-Of-Reset interrupt
 		sam.USB_DEVICE.INTFLAG.Set(sam.USB_DEVICE_INTFLAG_EORST)
 	}
 
+	// Suspend and resume
+	if (flags & sam.USB_DEVICE_INTFLAG_SUSPEND) > 0 {
+		setUSBSuspended(true)
+	}
+	if (flags & (sam.USB_DEVICE_INTFLAG_WAKEUP | sam.USB_DEVICE_INTFLAG_EORSM)) > 0 {
+		setUSBSuspended(false)
+	}
+
 	// Start of frame
 	if (flags & sam.USB_DEVICE_INTFLAG_SOF) > 0 {
 		USB.Flush()
 		// if you want to blink LED showing traffic, this would be the place...
+		if usbSOFHandler != nil {
+			usbSOFHandler((sam.USB_DEVICE.FNUM.Get() & sam.USB_DEVICE_FNUM_FNUM_Msk) >> sam.USB_DEVICE_FNUM_FNUM_Pos)
+		}
 	}
 
 	// Endpoint 0 Setup interrupt
@@ -2013,10 +2040,18 @@ func handleUSB(intr interrupt.Interrupt) {
 		setEPSTATUSCLR(0, sam.USB_DEVICE_EPSTATUSCLR_BK0RDY)
 		usbEndpointDescriptors[0].DeviceDescBank[0].PCKSIZE.ClearBits(usb_DEVICE_PCKSIZE_BYTE_COUNT_Mask << usb_DEVICE_PCKSIZE_BYTE_COUNT_Pos)
 
+		usbControlLength = setup.wLength
+
 		ok := false
 		if (setup.bmRequestType & usb_REQUEST_TYPE) == usb_REQUEST_STANDARD {
 			// Standard Requests
 			ok = handleStandardSetup(setup)
+		} else if (setup.bmRequestType & usb_REQUEST_TYPE) == usb_REQUEST_VENDOR {
+			// Vendor Requests
+			ok = handlerSetup(setup, usbVendorHandler)
+		} else if handler := classHandler(setup); handler != nil {
+			// Class Requests handled outside this package
+			ok = handlerSetup(setup, handler)
 		} else {
 			// Class Interface Requests
 			if setup.wIndex == usb_CDC_ACM_INTERFACE {
@@ -2029,7 +2064,7 @@ func handleUSB(intr interrupt.Interrupt) {
 			setEPSTATUSSET(0, sam.USB_DEVICE_EPSTATUSSET_BK1RDY)
 		} else {
 			// Stall endpoint
-			setEPSTATUSSET(0, sam.USB_DEVICE_EPINTFLAG_STALL1)
+			setEPSTATUSSET(0, sam.USB_DEVICE_EPSTATUSSET_STALLRQ1)
 		}
 
 		if getEPINTFLAG(0)&sam.USB_DEVICE_EPINTFLAG_STALL1 > 0 {
@@ -2058,6 +2093,8 @@ func handleUSB(intr interrupt.Interrupt) {
 
 				if i == usb_CDC_ENDPOINT_IN {
 					USB.waitTxc = false
+				} else {
+					startCDCNotification()
 				}
 			}
 		}
@@ -2145,42 +2182,63 @@ func initEndpoint(ep, config uint32) {
 }
 
 func handleStandardSetup(setup usbSetup) bool {
+	if !validStandardSetup(setup) {
+		return false
+	}
+
 	switch setup.bRequest {
 	case usb_GET_STATUS:
 		buf := []byte{0, 0}
 
-		if setup.bmRequestType != 0 { // endpoint
-			// TODO: actually check if the endpoint in question is currently halted
-			if isEndpointHalt {
+		if setup.bmRequestType&usb_REQUEST_RECIPIENT == usb_REQUEST_ENDPOINT {
+			if !validEndpointAddress(setup.wIndex) {
+				return false
+			}
+			if endpointHalted(setup.wIndex) {
 				buf[0] = 1
 			}
+		} else if setup.bmRequestType&usb_REQUEST_RECIPIENT == usb_REQUEST_DEVICE {
+			buf[0] = deviceStatus()
 		}
 
 		sendUSBPacket(0, buf)
 		return true
 
 	case usb_CLEAR_FEATURE:
-		if setup.wValueL == 1 { // DEVICEREMOTEWAKEUP
+		recipient := setup.bmRequestType & usb_REQUEST_RECIPIENT
+		if recipient == usb_REQUEST_DEVICE && setup.wValueL == usb_FEATURE_DEVICE_REMOTE_WAKEUP {
 			isRemoteWakeUpEnabled = false
-		} else if setup.wValueL == 0 { // ENDPOINTHALT
-			isEndpointHalt = false
+		} else if recipient == usb_REQUEST_ENDPOINT && setup.wValueL == usb_FEATURE_ENDPOINT_HALT {
+			if !hostSetEndpointHalt(setup.wIndex, false) {
+				return false
+			}
+		} else {
+			return false
 		}
 		sendZlp()
 		return true
 
 	case usb_SET_FEATURE:
-		if setup.wValueL == 1 { // DEVICEREMOTEWAKEUP
+		recipient := setup.bmRequestType & usb_REQUEST_RECIPIENT
+		if recipient == usb_REQUEST_DEVICE && setup.wValueL == usb_FEATURE_DEVICE_REMOTE_WAKEUP {
 			isRemoteWakeUpEnabled = true
-		} else if setup.wValueL == 0 { // ENDPOINTHALT
-			isEndpointHalt = true
+		} else if recipient == usb_REQUEST_ENDPOINT && setup.wValueL == usb_FEATURE_ENDPOINT_HALT {
+			if !hostSetEndpointHalt(setup.wIndex, true) {
+				return false
+			}
+		} else {
+			return false
 		}
 		sendZlp()
 		return true
 
 	case usb_SET_ADDRESS:
-		// set packet size 64 with auto Zlp after transfer
-		usbEndpointDescriptors[0].DeviceDescBank[1].PCKSIZE.Set((epPacketSize(64) << usb_DEVICE_PCKSIZE_SIZE_Pos) |
-			uint32(1<<31)) // autozlp
+		if setup.wValueL > 127 || setup.wValueH != 0 {
+			return false
+		}
+
+		// set packet size 64, auto Zlp is set per transfer by sendUSBPacket
+		usbEndpointDescriptors[0].DeviceDescBank[1].PCKSIZE.Set(epPacketSize(64) << usb_DEVICE_PCKSIZE_SIZE_Pos)
 
 		// ack the transfer is complete from the request
 		setEPINTFLAG(0, sam.USB_DEVICE_EPINTFLAG_TRCPT1)
@@ -2198,16 +2256,24 @@ func handleStandardSetup(setup usbSetup) bool {
 		}
 
 		// last, set the device address to that requested by host
-		sam.USB_DEVICE.DADD.SetBits(setup.wValueL)
-		sam.USB_DEVICE.DADD.SetBits(sam.USB_DEVICE_DADD_ADDEN)
+		if setup.wValueL == 0 {
+			// address 0 returns the device to the default state
+			sam.USB_DEVICE.DADD.Set(0)
+			usbConfiguration = 0
+			setUSBState(USBStateDefault)
+		} else {
+			sam.USB_DEVICE.DADD.Set(setup.wValueL | sam.USB_DEVICE_DADD_ADDEN)
+			setUSBState(USBStateAddressed)
+		}
 
 		return true
 
 	case usb_GET_DESCRIPTOR:
-		sendDescriptor(setup)
-		return true
+		return sendDescriptor(setup)
 
-	case usb_SET_DESCRIPTOR:
+	case usb_SET_DESCRIPTOR, usb_SYNCH_FRAME:
+		// Optional requests that are not supported: stall without touching
+		// any device state.
 		return false
 
 	case usb_GET_CONFIGURATION:
@@ -2217,11 +2283,29 @@ func handleStandardSetup(setup usbSetup) bool {
 
 	case usb_SET_CONFIGURATION:
 		if setup.bmRequestType&usb_REQUEST_RECIPIENT == usb_REQUEST_DEVICE {
-			for i := 1; i < len(endPoints); i++ {
-				initEndpoint(uint32(i), endPoints[i])
+			if setup.wValueL > usb_NUM_CONFIGURATIONS {
+				return false
 			}
 
 			usbConfiguration = setup.wValueL
+			clearEndpointHalts()
+
+			if usbConfiguration == 0 {
+				// back to the addressed state, disable all but the control
+				// endpoint
+				for i := 1; i < len(endPoints); i++ {
+					setEPCFG(uint32(i), 0)
+				}
+				setUSBState(USBStateAddressed)
+				sendZlp()
+				return true
+			}
+
+			for i := 1; i < len(endPoints); i++ {
+				initEndpoint(uint32(i), endPoints[i])
+			}
+			USB.rxPending = false
+			cdcNotification.pending = false
 
 			// Enable interrupt for CDC control messages from host (OUT packet)
 			setEPINTENSET(usb_CDC_ENDPOINT_ACM, sam.USB_DEVICE_EPINTENSET_TRCPT1)
@@ -2229,6 +2313,7 @@ func handleStandardSetup(setup usbSetup) bool {
 			// Enable interrupt for CDC data messages from host
 			setEPINTENSET(usb_CDC_ENDPOINT_OUT, sam.USB_DEVICE_EPINTENSET_TRCPT0)
 
+			setUSBState(USBStateConfigured)
 			sendZlp()
 			return true
 		} else {
@@ -2236,18 +2321,48 @@ func handleStandardSetup(setup usbSetup) bool {
 		}
 
 	case usb_GET_INTERFACE:
-		buff := []byte{usbSetInterface}
-		sendUSBPacket(0, buff)
+		alt, ok := getInterface(setup)
+		if !ok {
+			return false
+		}
+		sendUSBPacket(0, []byte{alt})
 		return true
 
 	case usb_SET_INTERFACE:
-		usbSetInterface = setup.wValueL
+		if !setInterface(setup) {
+			return false
+		}
 
 		sendZlp()
 		return true
 
 	default:
-		return true
+		return false
+	}
+}
+
+// setEndpointHalt halts or resumes the endpoint with the given address. The
+// data toggle is reset when the halt is cleared, as the host will start again
+// with DATA0.
+func setEndpointHalt(addr uint16, halt bool) {
+	ep := uint32(addr & 0x0f)
+	stall := uint8(sam.USB_DEVICE_EPSTATUSSET_STALLRQ0)
+	toggle := uint8(sam.USB_DEVICE_EPSTATUSCLR_DTGLOUT)
+	if addr&usbEndpointIn != 0 {
+		stall = sam.USB_DEVICE_EPSTATUSSET_STALLRQ1
+		toggle = sam.USB_DEVICE_EPSTATUSCLR_DTGLIN
+	}
+
+	if halt {
+		usbEndpointHalt |= endpointHaltBit(addr)
+		if ep != 0 {
+			setEPSTATUSSET(ep, stall)
+		}
+	} else {
+		usbEndpointHalt &^= endpointHaltBit(addr)
+		if ep != 0 {
+			setEPSTATUSCLR(ep, stall|toggle)
+		}
 	}
 }
 
@@ -2275,10 +2390,7 @@ func cdcSetup(setup usbSetup) bool {
 				return false
 			}
 
-			usbLineInfo.dwDTERate = uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16 | uint32(b[3])<<24
-			usbLineInfo.bCharFormat = b[4]
-			usbLineInfo.bParityType = b[5]
-			usbLineInfo.bDataBits = b[6]
+			setUSBLineCoding(b[:])
 		}
 
 		if setup.bRequest == usb_CDC_SET_CONTROL_LINE_STATE {
@@ -2306,24 +2418,119 @@ func cdcSetup(setup usbSetup) bool {
 	return false
 }
 
+// sendCDCNotification sends a notification on the CDC ACM interrupt endpoint.
+// If a previous notification is still waiting for the host, the new one is
+// queued and replaces any other queued notification.
+func sendCDCNotification(data []byte) {
+	mask := interrupt.Disable()
+	cdcNotification.length = copy(cdcNotification.data[:], data)
+	cdcNotification.pending = true
+	startCDCNotification()
+	interrupt.Restore(mask)
+}
+
+// startCDCNotification sends the queued notification, unless the bank still
+// holds the previous one. In that case it is sent from the interrupt handler
+// once the host picked up the previous one.
+func startCDCNotification() {
+	if !cdcNotification.pending || getEPSTATUS(usb_CDC_ENDPOINT_ACM)&sam.USB_DEVICE_EPSTATUS_BK1RDY != 0 {
+		return
+	}
+	cdcNotification.pending = false
+	sendUSBPacket(usb_CDC_ENDPOINT_ACM, cdcNotification.data[:cdcNotification.length])
+	setEPINTFLAG(usb_CDC_ENDPOINT_ACM, sam.USB_DEVICE_EPINTFLAG_TRCPT1)
+	setEPSTATUSSET(usb_CDC_ENDPOINT_ACM, sam.USB_DEVICE_EPSTATUSSET_BK1RDY)
+}
+
 //go:noinline
 func sendUSBPacket(ep uint32, data []byte) {
-	copy(udd_ep_in_cache_buffer[ep][:], data)
+	count := copy(udd_ep_in_cache_buffer[ep][:], data)
+	startUSBPacket(ep, &udd_ep_in_cache_buffer[ep][0], count)
+}
+
+// sendUSBControlData sends the data stage of a control IN request straight
+// from data, for data that does not fit in the endpoint 0 buffer. The data must
+// be word aligned and must not change until the transfer is complete.
+func sendUSBControlData(data []byte) {
+	startUSBPacket(0, &data[0], len(data))
+}
 
+// startUSBPacket sets up an IN transfer of count bytes from ptr. The hardware
+// splits it into packets.
+func startUSBPacket(ep uint32, ptr *byte, count int) {
 	// Set endpoint address for sending data
-	usbEndpointDescriptors[ep].DeviceDescBank[1].ADDR.Set(uint32(uintptr(unsafe.Pointer(&udd_ep_in_cache_buffer[ep]))))
+	usbEndpointDescriptors[ep].DeviceDescBank[1].ADDR.Set(uint32(uintptr(unsafe.Pointer(ptr))))
 
 	// clear multi-packet size which is total bytes already sent
 	usbEndpointDescriptors[ep].DeviceDescBank[1].PCKSIZE.ClearBits(usb_DEVICE_PCKSIZE_MULTI_PACKET_SIZE_Mask << usb_DEVICE_PCKSIZE_MULTI_PACKET_SIZE_Pos)
 
 	// set byte count, which is total number of bytes to be sent
 	usbEndpointDescriptors[ep].DeviceDescBank[1].PCKSIZE.ClearBits(usb_DEVICE_PCKSIZE_BYTE_COUNT_Mask << usb_DEVICE_PCKSIZE_BYTE_COUNT_Pos)
-	usbEndpointDescriptors[ep].DeviceDescBank[1].PCKSIZE.SetBits(uint32((len(data) & usb_DEVICE_PCKSIZE_BYTE_COUNT_Mask) << usb_DEVICE_PCKSIZE_BYTE_COUNT_Pos))
+	usbEndpointDescriptors[ep].DeviceDescBank[1].PCKSIZE.SetBits(uint32((count & usb_DEVICE_PCKSIZE_BYTE_COUNT_Mask) << usb_DEVICE_PCKSIZE_BYTE_COUNT_Pos))
+
+	// let the hardware end the transfer with a zero-length packet if needed
+	if ep == 0 && controlNeedsZLP(count) {
+		usbEndpointDescriptors[ep].DeviceDescBank[1].PCKSIZE.SetBits(usb_DEVICE_PCKSIZE_AUTO_ZLP)
+	} else {
+		usbEndpointDescriptors[ep].DeviceDescBank[1].PCKSIZE.ClearBits(usb_DEVICE_PCKSIZE_AUTO_ZLP)
+	}
+}
+
+// handlerSetup passes a control request to a USBControlHandler and sets up the
+// data or status stage. It returns false if the request must be stalled.
+func handlerSetup(setup usbSetup, handler USBControlHandler) bool {
+	if handler == nil {
+		return false
+	}
+
+	if setup.bmRequestType&usb_REQUEST_DIRECTION == usb_REQUEST_DEVICETOHOST {
+		b, ok := controlResponse(setup, handler)
+		if !ok {
+			return false
+		}
+		sendControlData(b)
+		return true
+	}
+
+	if setup.wLength > usbEndpointPacketSize {
+		// only a single data packet is supported
+		return false
+	}
+	var data []byte
+	if setup.wLength > 0 {
+		b, err := receiveUSBControlData()
+		if err != nil {
+			return false
+		}
+		data = b
+	}
+	if _, ok := handler(setup.controlRequest(), data); !ok {
+		return false
+	}
+	sendZlp()
+	return true
 }
 
 func receiveUSBControlPacket() ([cdcLineInfoSize]byte, error) {
 	var b [cdcLineInfoSize]byte
 
+	data, err := receiveUSBControlData()
+	if err != nil {
+		return b, err
+	}
+
+	if len(data) != cdcLineInfoSize {
+		return b, errUSBCDCBytesRead
+	}
+
+	copy(b[:7], data)
+
+	return b, nil
+}
+
+// receiveUSBControlData receives the data stage of a control OUT request. The
+// returned slice points into the endpoint 0 buffer.
+func receiveUSBControlData() ([]byte, error) {
 	// address
 	usbEndpointDescriptors[0].DeviceDescBank[0].ADDR.Set(uint32(uintptr(unsafe.Pointer(&udd_ep_out_cache_buffer[0]))))
 
@@ -2338,7 +2545,7 @@ func receiveUSBControlPacket() ([cdcLineInfoSize]byte, error) {
 	for (getEPSTATUS(0) & sam.USB_DEVICE_EPSTATUS_BK0RDY) == 0 {
 		timeout--
 		if timeout == 0 {
-			return b, errUSBCDCReadTimeout
+			return nil, errUSBCDCReadTimeout
 		}
 	}
 
@@ -2347,21 +2554,18 @@ func receiveUSBControlPacket() ([cdcLineInfoSize]byte, error) {
 	for (getEPINTFLAG(0) & sam.USB_DEVICE_EPINTFLAG_TRCPT0) == 0 {
 		timeout--
 		if timeout == 0 {
-			return b, errUSBCDCReadTimeout
+			return nil, errUSBCDCReadTimeout
 		}
 	}
 
 	// get data
 	bytesread := uint32((usbEndpointDescriptors[0].DeviceDescBank[0].PCKSIZE.Get() >>
 		usb_DEVICE_PCKSIZE_BYTE_COUNT_Pos) & usb_DEVICE_PCKSIZE_BYTE_COUNT_Mask)
-
-	if bytesread != cdcLineInfoSize {
-		return b, errUSBCDCBytesRead
+	if bytesread > usbEndpointPacketSize {
+		return nil, errUSBCDCBytesRead
 	}
 
-	copy(b[:7], udd_ep_out_cache_buffer[0][:7])
-
-	return b, nil
+	return udd_ep_out_cache_buffer[0][:bytesread], nil
 }
 
 func handleEndpoint(ep uint32) {
@@ -2369,6 +2573,15 @@ func handleEndpoint(ep uint32) {
 	count := int((usbEndpointDescriptors[ep].DeviceDescBank[0].PCKSIZE.Get() >>
 		usb_DEVICE_PCKSIZE_BYTE_COUNT_Pos) & usb_DEVICE_PCKSIZE_BYTE_COUNT_Mask)
 
+	// If the data does not fit in the ring buffer, leave it in the endpoint
+	// and do not set it ready: the host gets a NAK for anything it sends
+	// until the application has read enough data.
+	if bufferSize-int(USB.Buffer.Used()) < count {
+		USB.rxPending = true
+		return
+	}
+	USB.rxPending = false
+
 	// move to ring buffer
 	for i := 0; i < count; i++ {
 		USB.Receive(byte((udd_ep_out_cache_buffer[ep][i] & 0xFF)))
@@ -2384,6 +2597,30 @@ func handleEndpoint(ep uint32) {
 	setEPSTATUSCLR(ep, sam.USB_DEVICE_EPSTATUSCLR_BK0RDY)
 }
 
+// receivePending moves data that was held back in the CDC OUT endpoint to the
+// ring buffer, if there is room for it now.
+func (usbcdc *USBCDC) receivePending() {
+	mask := interrupt.Disable()
+	if usbcdc.rxPending {
+		handleEndpoint(usb_CDC_ENDPOINT_OUT)
+	}
+	interrupt.Restore(mask)
+}
+
+// setUSBPullup connects or disconnects the pull-up on D+.
+func setUSBPullup(enabled bool) {
+	if enabled {
+		sam.USB_DEVICE.CTRLB.ClearBits(sam.USB_DEVICE_CTRLB_DETACH)
+	} else {
+		sam.USB_DEVICE.CTRLB.SetBits(sam.USB_DEVICE_CTRLB_DETACH)
+	}
+}
+
+// sendRemoteWakeup drives resume signaling on the bus.
+func sendRemoteWakeup() {
+	sam.USB_DEVICE.CTRLB.SetBits(sam.USB_DEVICE_CTRLB_UPRSM)
+}
+
 func sendZlp() {
 	usbEndpointDescriptors[0].DeviceDescBank[1].PCKSIZE.ClearBits(usb_DEVICE_PCKSIZE_BYTE_COUNT_Mask << usb_DEVICE_PCKSIZE_BYTE_COUNT_Pos)
 }
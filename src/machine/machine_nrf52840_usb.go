@@ -4,7 +4,6 @@
 package machine
 
 import (
-	"device/arm"
 	"device/nrf"
 	"runtime/interrupt"
 	"runtime/volatile"
@@ -20,6 +19,7 @@ type USBCDC struct {
 	waitTxc           bool
 	waitTxcRetryCount uint8
 	sent              bool
+	rxPending         bool
 }
 
 const (
@@ -43,11 +43,14 @@ func (usbcdc *USBCDC) Flush() error {
 				usbcdc.waitTxcRetryCount++
 				return nil
 			}
+			// EasyDMA is busy, try again on the next start-of-frame
+			if !enterCriticalSection(easyDMACDCIn) {
+				return nil
+			}
 			usbcdc.waitTxc = true
 			usbcdc.waitTxcRetryCount = 0
 
 			// set the data
-			enterCriticalSection()
 			sendViaEPIn(
 				usb_CDC_ENDPOINT_IN,
 				&udd_ep_in_cache_buffer[usb_CDC_ENDPOINT_IN][bk],
@@ -96,7 +99,7 @@ func (usbcdc *USBCDC) WriteByte(c byte) error {
 				mask := interrupt.Disable()
 				if usbcdc.sent {
 					if usbcdc.waitTxc {
-						if !easyDMABusy.HasBits(1) {
+						if easyDMABusy.Get() != easyDMACDCIn {
 							usbcdc.waitTxc = false
 							usbcdc.Flush()
 						}
@@ -130,10 +133,9 @@ var (
 	udd_ep_out_cache_buffer [7][128]uint8
 
 	sendOnEP0DATADONE struct {
-		ptr   *byte
-		count int
+		data []byte // remaining data, sent one packet at a time
+		zlp  bool   // end with a zero-length packet
 	}
-	isEndpointHalt        = false
 	isRemoteWakeUpEnabled = false
 	endPoints             = []uint32{usb_ENDPOINT_TYPE_CONTROL,
 		(usb_ENDPOINT_TYPE_INTERRUPT | usbEndpointIn),
@@ -141,29 +143,59 @@ var (
 		(usb_ENDPOINT_TYPE_BULK | usbEndpointIn)}
 
 	usbConfiguration         uint8
-	usbSetInterface          uint8
 	usbLineInfo              = cdcLineInfo{115200, 0x00, 0x00, 0x08, 0x00}
 	epinen                   uint32
 	epouten                  uint32
-	easyDMABusy              volatile.Register8
+	easyDMABusy              volatile.Register8 // owner of EasyDMA, 0 if free
 	epout0data_setlinecoding bool
+
+	// the CDC OUT endpoint received data that could not be moved to RAM yet,
+	// because EasyDMA was busy
+	cdcOutPending bool
+
+	// CDC ACM notification queued by sendCDCNotification, and whether the
+	// previous one is still waiting for the host
+	cdcNotification struct {
+		data     [cdcSerialStateSize]byte
+		length   int
+		pending  bool
+		inFlight bool
+	}
+
+	// handler and request of a control OUT request that is waiting for its
+	// data stage
+	epout0data_handler USBControlHandler
+	epout0data_request USBControlRequest
 )
 
-// enterCriticalSection is used to protect access to easyDMA - only one thing
-// can be done with it at a time
-func enterCriticalSection() {
-	waitForEasyDMA()
-	easyDMABusy.SetBits(1)
-}
+// Owners of EasyDMA, see enterCriticalSection.
+const (
+	easyDMACDCIn = 1 + iota
+	easyDMACDCOut
+	easyDMANotification
+)
 
-func waitForEasyDMA() {
-	for easyDMABusy.HasBits(1) {
-		arm.Asm("wfi")
+// enterCriticalSection is used to protect access to easyDMA - only one thing
+// can be done with it at a time. It takes EasyDMA for owner and returns true,
+// or returns false if it is busy. It never waits: EasyDMA is released from the
+// USB interrupt handler, which is also where most transfers are started.
+func enterCriticalSection(owner uint8) bool {
+	mask := interrupt.Disable()
+	ok := easyDMABusy.Get() == 0
+	if ok {
+		easyDMABusy.Set(owner)
 	}
+	interrupt.Restore(mask)
+	return ok
 }
 
-func exitCriticalSection() {
-	easyDMABusy.ClearBits(1)
+// exitCriticalSection releases EasyDMA, if it is held by owner.
+func exitCriticalSection(owner uint8) {
+	mask := interrupt.Disable()
+	if easyDMABusy.Get() == owner {
+		easyDMABusy.Set(0)
+	}
+	interrupt.Restore(mask)
 }
 
 // Configure the USB CDC interface. The config is here for compatibility with the UART interface.
@@ -188,6 +220,7 @@ func (usbcdc *USBCDC) Configure(config UARTConfig) {
 		nrf.USBD_INTENSET_EPDATA |
 			nrf.USBD_INTENSET_EP0DATADONE |
 			nrf.USBD_INTENSET_USBEVENT |
+			nrf.USBD_INTENSET_USBRESET |
 			nrf.USBD_INTENSET_SOF |
 			nrf.USBD_INTENSET_EP0SETUP,
 	)
@@ -198,10 +231,26 @@ func (usbcdc *USBCDC) Configure(config UARTConfig) {
 }
 
 func (usbcdc *USBCDC) handleInterrupt(interrupt.Interrupt) {
+	// EasyDMA has read the notification, the buffer may be used again. This
+	// is handled first so that EasyDMA is free for the transfers below.
+	if nrf.USBD.EVENTS_ENDEPIN[usb_CDC_ENDPOINT_ACM].Get() > 0 {
+		nrf.USBD.EVENTS_ENDEPIN[usb_CDC_ENDPOINT_ACM].Set(0)
+		exitCriticalSection(easyDMANotification)
+	}
+
 	if nrf.USBD.EVENTS_SOF.Get() == 1 {
 		nrf.USBD.EVENTS_SOF.Set(0)
 		usbcdc.Flush()
 		// if you want to blink LED showing traffic, this would be the place...
+		if usbSOFHandler != nil {
+			usbSOFHandler(uint16(nrf.USBD.FRAMECNTR.Get() & 0x7ff))
+		}
+	}
+
+	// USB bus reset
+	if nrf.USBD.EVENTS_USBRESET.Get() == 1 {
+		nrf.USBD.EVENTS_USBRESET.Set(0)
+		resetUSBDevice()
 	}
 
 	// USBD ready event
@@ -216,7 +265,13 @@ func (usbcdc *USBCDC) handleInterrupt(interrupt.Interrupt) {
 			nrf.USBD.INTENSET.Set(nrf.USBD_INTENSET_EP0SETUP)
 			nrf.USBD.USBPULLUP.Set(1)
 
-			usbConfiguration = 0
+			resetUSBDevice()
+		}
+		if (nrf.USBD.EVENTCAUSE.Get() & nrf.USBD_EVENTCAUSE_SUSPEND) > 0 {
+			setUSBSuspended(true)
+		}
+		if (nrf.USBD.EVENTCAUSE.Get() & nrf.USBD_EVENTCAUSE_RESUME) > 0 {
+			setUSBSuspended(false)
 		}
 		nrf.USBD.EVENTCAUSE.Set(0)
 	}
@@ -224,22 +279,20 @@ func (usbcdc *USBCDC) handleInterrupt(interrupt.Interrupt) {
 	if nrf.USBD.EVENTS_EP0DATADONE.Get() == 1 {
 		// done sending packet - either need to send another or enter status stage
 		nrf.USBD.EVENTS_EP0DATADONE.Set(0)
-		if epout0data_setlinecoding {
+		if epout0data_setlinecoding || epout0data_handler != nil {
 			nrf.USBD.EPOUT[0].PTR.Set(uint32(uintptr(unsafe.Pointer(&udd_ep_out_cache_buffer[0]))))
 			nrf.USBD.EPOUT[0].MAXCNT.Set(64)
 			nrf.USBD.TASKS_STARTEPOUT[0].Set(1)
 			return
 		}
-		if sendOnEP0DATADONE.ptr != nil {
-			// previous data was too big for one packet, so send a second
-			sendViaEPIn(
-				0,
-				sendOnEP0DATADONE.ptr,
-				sendOnEP0DATADONE.count,
-			)
-
-			// clear, so we know we're done
-			sendOnEP0DATADONE.ptr = nil
+		if len(sendOnEP0DATADONE.data) != 0 {
+			// previous data was too big for one packet, so send the next
+			sendEP0Packet()
+		} else if sendOnEP0DATADONE.zlp {
+			// the data ended with a full packet, so the host needs a
+			// zero-length packet to know it is complete
+			sendOnEP0DATADONE.zlp = false
+			sendViaEPIn(0, &udd_ep_in_cache_buffer[0][0], 0)
 		} else {
 			// no more data, so set status stage
 			nrf.USBD.TASKS_EP0STATUS.Set(1)
@@ -255,10 +308,18 @@ func (usbcdc *USBCDC) handleInterrupt(interrupt.Interrupt) {
 		// parse setup
 		setup := parseUSBSetupRegisters()
 
+		usbControlLength = setup.wLength
+
 		ok := false
 		if (setup.bmRequestType & usb_REQUEST_TYPE) == usb_REQUEST_STANDARD {
 			// Standard Requests
 			ok = handleStandardSetup(setup)
+		} else if (setup.bmRequestType & usb_REQUEST_TYPE) == usb_REQUEST_VENDOR {
+			// Vendor Requests
+			ok = handlerSetup(setup, usbVendorHandler)
+		} else if handler := classHandler(setup); handler != nil {
+			// Class Requests handled outside this package
+			ok = handlerSetup(setup, handler)
 		} else {
 			if setup.wIndex == usb_CDC_ACM_INTERFACE {
 				ok = cdcSetup(setup)
@@ -284,18 +345,19 @@ func (usbcdc *USBCDC) handleInterrupt(interrupt.Interrupt) {
 			if inDataDone || outDataDone {
 				switch i {
 				case usb_CDC_ENDPOINT_OUT:
-					// setup buffer to receive from host
+					// setup buffer to receive from host, started below
 					if outDataDone {
-						enterCriticalSection()
-						nrf.USBD.EPOUT[i].PTR.Set(uint32(uintptr(unsafe.Pointer(&udd_ep_out_cache_buffer[i]))))
-						count := nrf.USBD.SIZE.EPOUT[i].Get()
-						nrf.USBD.EPOUT[i].MAXCNT.Set(count)
-						nrf.USBD.TASKS_STARTEPOUT[i].Set(1)
+						cdcOutPending = true
 					}
-				case usb_CDC_ENDPOINT_IN: //, usb_CDC_ENDPOINT_ACM:
+				case usb_CDC_ENDPOINT_IN:
 					if inDataDone {
 						usbcdc.waitTxc = false
-						exitCriticalSection()
+						exitCriticalSection(easyDMACDCIn)
+					}
+				case usb_CDC_ENDPOINT_ACM:
+					if inDataDone {
+						// the host picked up the notification
+						cdcNotification.inFlight = false
 					}
 				}
 			}
@@ -310,24 +372,73 @@ func (usbcdc *USBCDC) handleInterrupt(interrupt.Interrupt) {
 				epout0data_setlinecoding = false
 				count := int(nrf.USBD.SIZE.EPOUT[0].Get())
 				if count >= 7 {
-					parseUSBLineInfo(udd_ep_out_cache_buffer[0][:count])
+					setUSBLineCoding(udd_ep_out_cache_buffer[0][:count])
 					checkShouldReset()
 				}
 				nrf.USBD.TASKS_EP0STATUS.Set(1)
 			}
+			if i == 0 && epout0data_handler != nil {
+				handler := epout0data_handler
+				epout0data_handler = nil
+				count := int(nrf.USBD.SIZE.EPOUT[0].Get())
+				if _, ok := handler(epout0data_request, udd_ep_out_cache_buffer[0][:count]); ok {
+					nrf.USBD.TASKS_EP0STATUS.Set(1)
+				} else {
+					nrf.USBD.TASKS_EP0STALL.Set(1)
+				}
+			}
 			if i == usb_CDC_ENDPOINT_OUT {
 				usbcdc.handleEndpoint(uint32(i))
+				exitCriticalSection(easyDMACDCOut)
 			}
-			exitCriticalSection()
 		}
 	}
+
+	// Start the transfers that had to wait for EasyDMA. Every release of
+	// EasyDMA happens above, so nothing waits longer than one interrupt.
+	startCDCOut()
+	startCDCNotification()
 }
 
-func parseUSBLineInfo(b []byte) {
-	usbLineInfo.dwDTERate = uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16 | uint32(b[3])<<24
-	usbLineInfo.bCharFormat = b[4]
-	usbLineInfo.bParityType = b[5]
-	usbLineInfo.bDataBits = b[6]
+// startCDCOut moves the data received on the CDC OUT endpoint to RAM, if
+// there is any and EasyDMA is free.
+func startCDCOut() {
+	if !cdcOutPending || !enterCriticalSection(easyDMACDCOut) {
+		return
+	}
+	cdcOutPending = false
+	nrf.USBD.EPOUT[usb_CDC_ENDPOINT_OUT].PTR.Set(uint32(uintptr(unsafe.Pointer(&udd_ep_out_cache_buffer[usb_CDC_ENDPOINT_OUT]))))
+	count := nrf.USBD.SIZE.EPOUT[usb_CDC_ENDPOINT_OUT].Get()
+	nrf.USBD.EPOUT[usb_CDC_ENDPOINT_OUT].MAXCNT.Set(count)
+	nrf.USBD.TASKS_STARTEPOUT[usb_CDC_ENDPOINT_OUT].Set(1)
+}
+
+// resetUSBDevice returns the device to the default state after a bus reset,
+// which also aborts any transfer in progress.
+func resetUSBDevice() {
+	usbConfiguration = 0
+	disableEndpoints()
+	clearEndpointHalts()
+	epout0data_handler = nil
+	epout0data_setlinecoding = false
+	sendOnEP0DATADONE.data = nil
+	sendOnEP0DATADONE.zlp = false
+	easyDMABusy.Set(0)
+	cdcOutPending = false
+	cdcNotification.pending = false
+	cdcNotification.inFlight = false
+	USB.waitTxc = false
+	isRemoteWakeUpEnabled = false
+	usbSuspended = false
+	setUSBState(USBStateDefault)
+}
+
+// disableEndpoints disables all but the control endpoint.
+func disableEndpoints() {
+	epinen = nrf.USBD_EPINEN_IN0
+	epouten = nrf.USBD_EPOUTEN_OUT0
+	nrf.USBD.EPINEN.Set(epinen)
+	nrf.USBD.EPOUTEN.Set(epouten)
 }
 
 func parseUSBSetupRegisters() usbSetup {
@@ -344,6 +455,7 @@ func parseUSBSetupRegisters() usbSetup {
 func initEndpoint(ep, config uint32) {
 	switch config {
 	case usb_ENDPOINT_TYPE_INTERRUPT | usbEndpointIn:
+		nrf.USBD.INTENSET.Set(nrf.USBD_INTENSET_ENDEPIN0 << ep)
 		enableEPIn(ep)
 
 	case usb_ENDPOINT_TYPE_BULK | usbEndpointOut:
@@ -368,46 +480,74 @@ func initEndpoint(ep, config uint32) {
 }
 
 func handleStandardSetup(setup usbSetup) bool {
+	if !validStandardSetup(setup) {
+		return false
+	}
+
 	switch setup.bRequest {
 	case usb_GET_STATUS:
 		buf := []byte{0, 0}
 
-		if setup.bmRequestType != 0 { // endpoint
-			if isEndpointHalt {
+		if setup.bmRequestType&usb_REQUEST_RECIPIENT == usb_REQUEST_ENDPOINT {
+			if !validEndpointAddress(setup.wIndex) {
+				return false
+			}
+			if endpointHalted(setup.wIndex) {
 				buf[0] = 1
 			}
+		} else if setup.bmRequestType&usb_REQUEST_RECIPIENT == usb_REQUEST_DEVICE {
+			buf[0] = deviceStatus()
 		}
 
 		sendUSBPacket(0, buf)
 		return true
 
 	case usb_CLEAR_FEATURE:
-		if setup.wValueL == 1 { // DEVICEREMOTEWAKEUP
+		recipient := setup.bmRequestType & usb_REQUEST_RECIPIENT
+		if recipient == usb_REQUEST_DEVICE && setup.wValueL == usb_FEATURE_DEVICE_REMOTE_WAKEUP {
 			isRemoteWakeUpEnabled = false
-		} else if setup.wValueL == 0 { // ENDPOINTHALT
-			isEndpointHalt = false
+		} else if recipient == usb_REQUEST_ENDPOINT && setup.wValueL == usb_FEATURE_ENDPOINT_HALT {
+			if !hostSetEndpointHalt(setup.wIndex, false) {
+				return false
+			}
+		} else {
+			return false
 		}
 		nrf.USBD.TASKS_EP0STATUS.Set(1)
 		return true
 
 	case usb_SET_FEATURE:
-		if setup.wValueL == 1 { // DEVICEREMOTEWAKEUP
+		recipient := setup.bmRequestType & usb_REQUEST_RECIPIENT
+		if recipient == usb_REQUEST_DEVICE && setup.wValueL == usb_FEATURE_DEVICE_REMOTE_WAKEUP {
 			isRemoteWakeUpEnabled = true
-		} else if setup.wValueL == 0 { // ENDPOINTHALT
-			isEndpointHalt = true
+		} else if recipient == usb_REQUEST_ENDPOINT && setup.wValueL == usb_FEATURE_ENDPOINT_HALT {
+			if !hostSetEndpointHalt(setup.wIndex, true) {
+				return false
+			}
+		} else {
+			return false
 		}
 		nrf.USBD.TASKS_EP0STATUS.Set(1)
 		return true
 
 	case usb_SET_ADDRESS:
 		// nrf USBD handles this
+		if setup.wValueL == 0 {
+			// address 0 returns the device to the default state
+			usbConfiguration = 0
+			disableEndpoints()
+			setUSBState(USBStateDefault)
+		} else {
+			setUSBState(USBStateAddressed)
+		}
 		return true
 
 	case usb_GET_DESCRIPTOR:
-		sendDescriptor(setup)
-		return true
+		return sendDescriptor(setup)
 
-	case usb_SET_DESCRIPTOR:
+	case usb_SET_DESCRIPTOR, usb_SYNCH_FRAME:
+		// Optional requests that are not supported: stall without touching
+		// any device state.
 		return false
 
 	case usb_GET_CONFIGURATION:
@@ -417,30 +557,79 @@ func handleStandardSetup(setup usbSetup) bool {
 
 	case usb_SET_CONFIGURATION:
 		if setup.bmRequestType&usb_REQUEST_RECIPIENT == usb_REQUEST_DEVICE {
+			if setup.wValueL > usb_NUM_CONFIGURATIONS {
+				return false
+			}
+
 			nrf.USBD.TASKS_EP0STATUS.Set(1)
+			usbConfiguration = setup.wValueL
+			clearEndpointHalts()
+
+			if usbConfiguration == 0 {
+				// back to the addressed state
+				disableEndpoints()
+				setUSBState(USBStateAddressed)
+				return true
+			}
+
 			for i := 1; i < len(endPoints); i++ {
 				initEndpoint(uint32(i), endPoints[i])
 			}
-
-			usbConfiguration = setup.wValueL
+			USB.rxPending = false
+			cdcOutPending = false
+			cdcNotification.pending = false
+			cdcNotification.inFlight = false
+			setUSBState(USBStateConfigured)
 			return true
 		} else {
 			return false
 		}
 
 	case usb_GET_INTERFACE:
-		buff := []byte{usbSetInterface}
-		sendUSBPacket(0, buff)
+		alt, ok := getInterface(setup)
+		if !ok {
+			return false
+		}
+		sendUSBPacket(0, []byte{alt})
 		return true
 
 	case usb_SET_INTERFACE:
-		usbSetInterface = setup.wValueL
+		if !setInterface(setup) {
+			return false
+		}
 
 		nrf.USBD.TASKS_EP0STATUS.Set(1)
 		return true
 
 	default:
-		return true
+		return false
+	}
+}
+
+// setEndpointHalt halts or resumes the endpoint with the given address. The
+// data toggle is reset when the halt is cleared, as the host will start again
+// with DATA0.
+func setEndpointHalt(addr uint16, halt bool) {
+	ep := uint32(addr & 0x0f)
+	io := uint32(nrf.USBD_EPSTALL_IO_Out)
+	if addr&usbEndpointIn != 0 {
+		io = nrf.USBD_EPSTALL_IO_In
+	}
+
+	if halt {
+		usbEndpointHalt |= endpointHaltBit(addr)
+		if ep != 0 {
+			nrf.USBD.EPSTALL.Set(ep<<nrf.USBD_EPSTALL_EP_Pos | io<<nrf.USBD_EPSTALL_IO_Pos |
+				nrf.USBD_EPSTALL_STALL_Stall<<nrf.USBD_EPSTALL_STALL_Pos)
+		}
+	} else {
+		usbEndpointHalt &^= endpointHaltBit(addr)
+		if ep != 0 {
+			nrf.USBD.EPSTALL.Set(ep<<nrf.USBD_EPSTALL_EP_Pos | io<<nrf.USBD_EPSTALL_IO_Pos |
+				nrf.USBD_EPSTALL_STALL_UnStall<<nrf.USBD_EPSTALL_STALL_Pos)
+			nrf.USBD.DTOGGLE.Set(ep<<nrf.USBD_DTOGGLE_EP_Pos | io<<nrf.USBD_DTOGGLE_IO_Pos |
+				nrf.USBD_DTOGGLE_VALUE_Data0<<nrf.USBD_DTOGGLE_VALUE_Pos)
+		}
 	}
 }
 
@@ -482,14 +671,77 @@ func cdcSetup(setup usbSetup) bool {
 	return false
 }
 
+// handlerSetup passes a control request to a USBControlHandler and sets up the
+// data or status stage. It returns false if the request must be stalled. The
+// handler of a host-to-device request with a data stage is called once the
+// data has been received.
+func handlerSetup(setup usbSetup, handler USBControlHandler) bool {
+	if handler == nil {
+		return false
+	}
+
+	if setup.bmRequestType&usb_REQUEST_DIRECTION == usb_REQUEST_DEVICETOHOST {
+		b, ok := controlResponse(setup, handler)
+		if !ok {
+			return false
+		}
+		sendControlData(b)
+		return true
+	}
+
+	if setup.wLength > usbEndpointPacketSize {
+		// only a single data packet is supported
+		return false
+	}
+	if setup.wLength > 0 {
+		epout0data_handler = handler
+		epout0data_request = setup.controlRequest()
+		nrf.USBD.TASKS_EP0RCVOUT.Set(1)
+		return true
+	}
+	if _, ok := handler(setup.controlRequest(), nil); !ok {
+		return false
+	}
+	nrf.USBD.TASKS_EP0STATUS.Set(1)
+	return true
+}
+
+// sendCDCNotification sends a notification on the CDC ACM interrupt endpoint.
+// If a previous notification is still waiting for the host, the new one is
+// queued and replaces any other queued notification.
+func sendCDCNotification(data []byte) {
+	mask := interrupt.Disable()
+	cdcNotification.length = copy(cdcNotification.data[:], data)
+	cdcNotification.pending = true
+	startCDCNotification()
+	interrupt.Restore(mask)
+}
+
+// startCDCNotification starts the DMA of the queued notification, unless the
+// previous one was not picked up by the host yet or EasyDMA is busy. In that
+// case it is tried again later from the interrupt handler, as this never waits
+// for EasyDMA.
+func startCDCNotification() {
+	if !cdcNotification.pending || cdcNotification.inFlight ||
+		!enterCriticalSection(easyDMANotification) { // released on ENDEPIN
+		return
+	}
+	cdcNotification.pending = false
+	cdcNotification.inFlight = true
+	copy(udd_ep_in_cache_buffer[usb_CDC_ENDPOINT_ACM][:], cdcNotification.data[:cdcNotification.length])
+	sendViaEPIn(
+		usb_CDC_ENDPOINT_ACM,
+		&udd_ep_in_cache_buffer[usb_CDC_ENDPOINT_ACM][0],
+		cdcNotification.length,
+	)
+}
+
 //go:noinline
 func sendUSBPacket(ep uint32, data []byte) {
-	count := len(data)
-	copy(udd_ep_in_cache_buffer[ep][:], data)
-	if ep == 0 && count > usbEndpointPacketSize {
-		sendOnEP0DATADONE.ptr = &udd_ep_in_cache_buffer[ep][usbEndpointPacketSize]
-		sendOnEP0DATADONE.count = count - usbEndpointPacketSize
-		count = usbEndpointPacketSize
+	count := copy(udd_ep_in_cache_buffer[ep][:], data)
+	if ep == 0 && count != 0 {
+		sendUSBControlData(udd_ep_in_cache_buffer[ep][:count])
+		return
 	}
 	sendViaEPIn(
 		ep,
@@ -498,10 +750,38 @@ func sendUSBPacket(ep uint32, data []byte) {
 	)
 }
 
+// sendUSBControlData sends the data stage of a control IN request straight
+// from data, one packet at a time. The data must not change until the transfer
+// is complete.
+func sendUSBControlData(data []byte) {
+	sendOnEP0DATADONE.zlp = controlNeedsZLP(len(data))
+	sendOnEP0DATADONE.data = data
+	sendEP0Packet()
+}
+
+// sendEP0Packet sends the next packet of the control IN data stage.
+func sendEP0Packet() {
+	data := sendOnEP0DATADONE.data
+	if len(data) > usbEndpointPacketSize {
+		data = data[:usbEndpointPacketSize]
+	}
+	sendOnEP0DATADONE.data = sendOnEP0DATADONE.data[len(data):]
+	sendViaEPIn(0, &data[0], len(data))
+}
+
 func (usbcdc *USBCDC) handleEndpoint(ep uint32) {
 	// get data
 	count := int(nrf.USBD.EPOUT[ep].AMOUNT.Get())
 
+	// If the data does not fit in the ring buffer, leave it in the endpoint
+	// buffer and do not set the endpoint ready: the host gets a NAK for
+	// anything it sends until the application has read enough data.
+	if bufferSize-int(usbcdc.Buffer.Used()) < count {
+		usbcdc.rxPending = true
+		return
+	}
+	usbcdc.rxPending = false
+
 	// move to ring buffer
 	for i := 0; i < count; i++ {
 		usbcdc.Receive(byte(udd_ep_out_cache_buffer[ep][i]))
@@ -511,6 +791,31 @@ func (usbcdc *USBCDC) handleEndpoint(ep uint32) {
 	nrf.USBD.SIZE.EPOUT[ep].Set(0)
 }
 
+// receivePending moves data that was held back in the CDC OUT endpoint to the
+// ring buffer, if there is room for it now.
+func (usbcdc *USBCDC) receivePending() {
+	mask := interrupt.Disable()
+	if usbcdc.rxPending {
+		usbcdc.handleEndpoint(usb_CDC_ENDPOINT_OUT)
+	}
+	interrupt.Restore(mask)
+}
+
+// setUSBPullup connects or disconnects the pull-up on D+.
+func setUSBPullup(enabled bool) {
+	if enabled {
+		nrf.USBD.USBPULLUP.Set(1)
+	} else {
+		nrf.USBD.USBPULLUP.Set(0)
+	}
+}
+
+// sendRemoteWakeup drives resume signaling on the bus.
+func sendRemoteWakeup() {
+	nrf.USBD.DPDMVALUE.Set(nrf.USBD_DPDMVALUE_STATE_Resume)
+	nrf.USBD.TASKS_DPDMDRIVE.Set(1)
+}
+
 func sendZlp() {
 	nrf.USBD.TASKS_EP0STATUS.Set(1)
 }
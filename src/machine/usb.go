@@ -5,12 +5,18 @@ package machine
 
 import (
 	"errors"
+	"runtime/interrupt"
 	"runtime/volatile"
+	"unsafe"
 )
 
 const deviceDescriptorSize = 18
 
 var (
+	errUSBStringIndex         = errors.New("USB string descriptor index is reserved")
+	errUSBLanguageExists      = errors.New("USB language already registered")
+	errUSBCapabilitySize      = errors.New("USB device capabilities do not fit in the BOS descriptor")
+	errUSBWakeupDisabled      = errors.New("USB remote wakeup not enabled by the host")
 	errUSBCDCBufferEmpty      = errors.New("USB-CDC buffer empty")
 	errUSBCDCWriteByteTimeout = errors.New("USB-CDC write byte timeout")
 	errUSBCDCReadTimeout      = errors.New("USB-CDC read timeout")
@@ -418,62 +424,213 @@ type cdcLineInfo struct {
 	lineState   uint8
 }
 
-// strToUTF16LEDescriptor converts a utf8 string into a string descriptor
-// note: the following code only converts ascii characters to UTF16LE. In order
-// to do a "proper" conversion, we would need to pull in the 'unicode/utf16'
-// package, which at the time this was written added 512 bytes to the compiled
-// binary.
-func strToUTF16LEDescriptor(in string, out []byte) {
-	out[0] = byte(len(out))
-	out[1] = usb_STRING_DESCRIPTOR_TYPE
-	for i, rune := range in {
-		out[(i<<1)+2] = byte(rune)
-		out[(i<<1)+3] = 0
+// USBCDCLineCoding is the line coding of the USB-CDC interface, as set by the
+// host.
+type USBCDCLineCoding struct {
+	BaudRate uint32
+	StopBits uint8 // 0: 1 stop bit, 1: 1.5 stop bits, 2: 2 stop bits
+	Parity   uint8 // 0: none, 1: odd, 2: even, 3: mark, 4: space
+	DataBits uint8
+}
+
+var (
+	// usbLineCodingSave is called with the new line coding every time the
+	// host changes it.
+	usbLineCodingSave func(USBCDCLineCoding)
+
+	// usbLineCodingSet is set once the host has sent SET_LINE_CODING.
+	usbLineCodingSet bool
+)
+
+// SetLineCodingStorage registers a pair of functions that persist the line
+// coding across reboots, for example in flash. The load function is called
+// right away and its result, if ok, replaces the default line coding of
+// 115200 8N1. The runtime configures USB before main runs, so the host may
+// already have set a line coding by then. The loaded one is only applied if
+// the host has not, so that it never overwrites a line coding set by the host.
+// The save function is called from the USB interrupt handler every time the
+// host changes the line coding, so it should return quickly. Either function
+// may be nil.
+func (usbcdc *USBCDC) SetLineCodingStorage(load func() (lc USBCDCLineCoding, ok bool), save func(USBCDCLineCoding)) {
+	var lc USBCDCLineCoding
+	ok := false
+	if load != nil {
+		lc, ok = load()
+	}
+
+	mask := interrupt.Disable()
+	usbLineCodingSave = save
+	if ok && !usbLineCodingSet {
+		usbLineInfo.dwDTERate = lc.BaudRate
+		usbLineInfo.bCharFormat = lc.StopBits
+		usbLineInfo.bParityType = lc.Parity
+		usbLineInfo.bDataBits = lc.DataBits
+	}
+	interrupt.Restore(mask)
+}
+
+// setUSBLineCoding applies the data stage of a SET_LINE_CODING request, and
+// passes the line coding to the save function registered with
+// SetLineCodingStorage if it changed.
+func setUSBLineCoding(b []byte) {
+	old := usbLineInfo
+	usbLineInfo.dwDTERate = uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16 | uint32(b[3])<<24
+	usbLineInfo.bCharFormat = b[4]
+	usbLineInfo.bParityType = b[5]
+	usbLineInfo.bDataBits = b[6]
+	usbLineCodingSet = true
+
+	// 1200 baud is the touch used to reset into the bootloader, restoring it
+	// after a reboot would reset the board again as soon as DTR drops.
+	if usbLineInfo == old || usbLineCodingSave == nil || usbLineInfo.dwDTERate == 1200 {
+		return
+	}
+	usbLineCodingSave(USBCDCLineCoding{
+		BaudRate: usbLineInfo.dwDTERate,
+		StopBits: usbLineInfo.bCharFormat,
+		Parity:   usbLineInfo.bParityType,
+		DataBits: usbLineInfo.bDataBits,
+	})
+}
+
+// USBDeviceConfig holds the identifiers and strings reported in the USB device
+// descriptor. Fields that are left at zero keep the default for the board.
+type USBDeviceConfig struct {
+	VID       uint16
+	PID       uint16
+	BCDDevice uint16 // device release number, 0x0100 for 1.00
+
+	Manufacturer string
+	Product      string
+	SerialNumber string // no serial number is reported by default
+
+	// SelfPowered reports the device as self-powered instead of bus-powered.
+	// Unlike the other fields it is always applied, so false switches back
+	// to bus-powered.
+	SelfPowered bool
+	// MaxPower is the maximum current drawn from the bus in mA, at most 500.
+	// The default is 100mA.
+	MaxPower uint16
+}
+
+// ConfigureUSBDevice changes the identifiers and strings that are reported in
+// the USB device descriptor. The runtime configures USB before main runs, so
+// the host has usually enumerated the device by the time this is called, and
+// most hosts cache the descriptors. Call USBDetach and then USBAttach
+// afterwards to make the host enumerate the device again with the new values.
+func ConfigureUSBDevice(config USBDeviceConfig) {
+	if config.MaxPower > 500 {
+		config.MaxPower = 500
+	}
+
+	mask := interrupt.Disable()
+	if config.VID != 0 {
+		usb_VID = config.VID
+	}
+	if config.PID != 0 {
+		usb_PID = config.PID
+	}
+	if config.BCDDevice != 0 {
+		usb_BCD_DEVICE = config.BCDDevice
+	}
+	if config.Manufacturer != "" {
+		usbStringManufacturer = config.Manufacturer
+	}
+	if config.Product != "" {
+		usbStringProduct = config.Product
 	}
-	return
+	if config.SerialNumber != "" {
+		usbStringSerial = config.SerialNumber
+	}
+	usbSelfPowered = config.SelfPowered
+	if config.MaxPower != 0 {
+		// bMaxPower is in units of 2mA
+		usbMaxPower = uint8((config.MaxPower + 1) / 2)
+	}
+	interrupt.Restore(mask)
+}
+
+// SetUSBString registers an additional string descriptor, for example to be
+// referenced from a custom interface descriptor. The index must be above the
+// indices used for the manufacturer, product and serial number strings.
+func SetUSBString(index uint8, str string) error {
+	if index <= usb_ISERIAL {
+		return errUSBStringIndex
+	}
+	mask := interrupt.Disable()
+	if usbExtraStrings == nil {
+		usbExtraStrings = make(map[uint8]string)
+	}
+	usbExtraStrings[index] = str
+	interrupt.Restore(mask)
+	return nil
 }
 
 var (
-	// TODO: allow setting these
-	usb_STRING_LANGUAGE = [2]uint16{(3 << 8) | (2 + 2), 0x0409} // English
+	usb_BCD_DEVICE uint16 = 0x100
+
+	// power attributes in the configuration descriptor
+	usbSelfPowered bool
+	usbMaxPower    uint8 = 50 // 100mA
+
+	usbStringManufacturer = usb_STRING_MANUFACTURER
+	usbStringProduct      = usb_STRING_PRODUCT
+	usbStringSerial       string
+	usbExtraStrings       map[uint8]string
+
+	// languages added with AddUSBLanguage
+	usbLanguages []usbLanguage
 )
 
+// USBStrings is a set of USB strings in one language. Empty strings fall back to
+// the default (US English) string with the same index.
+type USBStrings struct {
+	Manufacturer string
+	Product      string
+	SerialNumber string
+	Extra        map[uint8]string // indexed like SetUSBString
+}
+
+// AddUSBLanguage registers the strings for another language, identified by its
+// USB language ID (for example 0x0407 for German). The list of languages
+// reported to the host is updated to match.
+func AddUSBLanguage(langID uint16, strings USBStrings) error {
+	if langID == 0 || langID == usb_LANGID_DEFAULT {
+		return errUSBLanguageExists
+	}
+	mask := interrupt.Disable()
+	for _, lang := range usbLanguages {
+		if lang.langID == langID {
+			interrupt.Restore(mask)
+			return errUSBLanguageExists
+		}
+	}
+	usbLanguages = append(usbLanguages, usbLanguage{
+		langID:       langID,
+		manufacturer: strings.Manufacturer,
+		product:      strings.Product,
+		serial:       strings.SerialNumber,
+		extra:        strings.Extra,
+	})
+	interrupt.Restore(mask)
+	return nil
+}
+
 const (
-	usb_IMANUFACTURER = 1
-	usb_IPRODUCT      = 2
-	usb_ISERIAL       = 3
+	// number of configurations in the device descriptor
+	usb_NUM_CONFIGURATIONS = 1
+
+	// number of interfaces in the configuration descriptor
+	usb_NUM_INTERFACES = 2
 
 	usb_ENDPOINT_TYPE_CONTROL     = 0x00
 	usb_ENDPOINT_TYPE_ISOCHRONOUS = 0x01
 	usb_ENDPOINT_TYPE_BULK        = 0x02
 	usb_ENDPOINT_TYPE_INTERRUPT   = 0x03
 
-	usb_DEVICE_DESCRIPTOR_TYPE        = 1
-	usb_CONFIGURATION_DESCRIPTOR_TYPE = 2
-	usb_STRING_DESCRIPTOR_TYPE        = 3
-	usb_INTERFACE_DESCRIPTOR_TYPE     = 4
-	usb_ENDPOINT_DESCRIPTOR_TYPE      = 5
-	usb_DEVICE_QUALIFIER              = 6
-	usb_OTHER_SPEED_CONFIGURATION     = 7
-
-	usbEndpointOut = 0x00
-	usbEndpointIn  = 0x80
-
 	usbEndpointPacketSize = 64 // 64 for Full Speed, EPT size max is 1024
 	usb_EPT_NUM           = 7
 
-	// standard requests
-	usb_GET_STATUS        = 0
-	usb_CLEAR_FEATURE     = 1
-	usb_SET_FEATURE       = 3
-	usb_SET_ADDRESS       = 5
-	usb_GET_DESCRIPTOR    = 6
-	usb_SET_DESCRIPTOR    = 7
-	usb_GET_CONFIGURATION = 8
-	usb_SET_CONFIGURATION = 9
-	usb_GET_INTERFACE     = 10
-	usb_SET_INTERFACE     = 11
-
 	usb_DEVICE_CLASS_COMMUNICATIONS  = 0x02
 	usb_DEVICE_CLASS_HUMAN_INTERFACE = 0x03
 	usb_DEVICE_CLASS_STORAGE         = 0x08
@@ -492,32 +649,15 @@ const (
 	usb_CDC_ENDPOINT_OUT   = 2
 	usb_CDC_ENDPOINT_IN    = 3
 
-	// bmRequestType
-	usb_REQUEST_HOSTTODEVICE = 0x00
-	usb_REQUEST_DEVICETOHOST = 0x80
-	usb_REQUEST_DIRECTION    = 0x80
-
-	usb_REQUEST_STANDARD = 0x00
-	usb_REQUEST_CLASS    = 0x20
-	usb_REQUEST_VENDOR   = 0x40
-	usb_REQUEST_TYPE     = 0x60
-
-	usb_REQUEST_DEVICE    = 0x00
-	usb_REQUEST_INTERFACE = 0x01
-	usb_REQUEST_ENDPOINT  = 0x02
-	usb_REQUEST_OTHER     = 0x03
-	usb_REQUEST_RECIPIENT = 0x1F
-
-	usb_REQUEST_DEVICETOHOST_CLASS_INTERFACE    = (usb_REQUEST_DEVICETOHOST | usb_REQUEST_CLASS | usb_REQUEST_INTERFACE)
-	usb_REQUEST_HOSTTODEVICE_CLASS_INTERFACE    = (usb_REQUEST_HOSTTODEVICE | usb_REQUEST_CLASS | usb_REQUEST_INTERFACE)
-	usb_REQUEST_DEVICETOHOST_STANDARD_INTERFACE = (usb_REQUEST_DEVICETOHOST | usb_REQUEST_STANDARD | usb_REQUEST_INTERFACE)
-
 	// CDC Class requests
 	usb_CDC_SET_LINE_CODING        = 0x20
 	usb_CDC_GET_LINE_CODING        = 0x21
 	usb_CDC_SET_CONTROL_LINE_STATE = 0x22
 	usb_CDC_SEND_BREAK             = 0x23
 
+	// CDC notifications
+	usb_CDC_SERIAL_STATE = 0x20
+
 	usb_CDC_V1_10                         = 0x0110
 	usb_CDC_COMMUNICATION_INTERFACE_CLASS = 0x02
 
@@ -534,6 +674,20 @@ const (
 	usb_CDC_LINESTATE_RTS = 0x02
 )
 
+// Bits for USBCDC.SetSerialState, as defined for the CDC SERIAL_STATE
+// notification.
+const (
+	USBCDCSerialStateDCD     = 1 << 0 // data carrier detect (bRxCarrier)
+	USBCDCSerialStateDSR     = 1 << 1 // data set ready (bTxCarrier)
+	USBCDCSerialStateBreak   = 1 << 2 // break detected
+	USBCDCSerialStateRI      = 1 << 3 // ring indicator
+	USBCDCSerialStateFraming = 1 << 4 // framing error
+	USBCDCSerialStateParity  = 1 << 5 // parity error
+	USBCDCSerialStateOverrun = 1 << 6 // receive overrun
+)
+
+const cdcSerialStateSize = 10
+
 // usbDeviceDescBank is the USB device endpoint descriptor.
 // typedef struct {
 // 	__IO USB_DEVICE_ADDR_Type      ADDR;        /**< \brief Offset: 0x000 (R/W 32) DEVICE_DESC_BANK Endpoint Bank, Adress of Data Buffer */
@@ -554,39 +708,349 @@ type usbDeviceDescriptor struct {
 	DeviceDescBank [2]usbDeviceDescBank
 }
 
-// typedef struct {
-// 	union {
-// 		uint8_t bmRequestType;
-// 		struct {
-// 			uint8_t direction : 5;
-// 			uint8_t type : 2;
-// 			uint8_t transferDirection : 1;
-// 		};
-// 	};
-// 	uint8_t bRequest;
-// 	uint8_t wValueL;
-// 	uint8_t wValueH;
-// 	uint16_t wIndex;
-// 	uint16_t wLength;
-// } USBSetup;
-type usbSetup struct {
-	bmRequestType uint8
-	bRequest      uint8
-	wValueL       uint8
-	wValueH       uint8
-	wIndex        uint16
-	wLength       uint16
-}
-
-func newUSBSetup(data []byte) usbSetup {
-	u := usbSetup{}
-	u.bmRequestType = uint8(data[0])
-	u.bRequest = uint8(data[1])
-	u.wValueL = uint8(data[2])
-	u.wValueH = uint8(data[3])
-	u.wIndex = uint16(data[4]) | (uint16(data[5]) << 8)
-	u.wLength = uint16(data[6]) | (uint16(data[7]) << 8)
-	return u
+// usbEndpointHalt is a bitmap of the endpoints that have been halted by the
+// host: bit n is set when OUT endpoint n is halted, bit n+8 when IN endpoint n
+// is halted.
+var usbEndpointHalt uint16
+
+// validEndpointAddress returns whether addr, as found in the wIndex field of an
+// endpoint request, refers to an endpoint of the current configuration.
+func validEndpointAddress(addr uint16) bool {
+	if addr&^(usbEndpointIn|0x0f) != 0 {
+		return false
+	}
+	ep := int(addr & 0x0f)
+	if ep == 0 {
+		return true
+	}
+	if ep >= len(endPoints) || usbConfiguration == 0 {
+		return false
+	}
+	return uint16(endPoints[ep]&usbEndpointIn) == addr&usbEndpointIn
+}
+
+// endpointHalted returns whether the endpoint with the given address is
+// currently halted.
+func endpointHalted(addr uint16) bool {
+	return usbEndpointHalt&endpointHaltBit(addr) != 0
+}
+
+// clearEndpointHalts clears the halt feature of every halted endpoint, which
+// the specification requires after a bus reset and on SET_CONFIGURATION. The
+// stall is cleared in hardware too, not just in usbEndpointHalt.
+func clearEndpointHalts() {
+	for i := uint16(0); i < 16; i++ {
+		if usbEndpointHalt&(1<<i) == 0 {
+			continue
+		}
+		setEndpointHalt(endpointHaltAddress(i), false)
+	}
+}
+
+// usbEndpointHaltHandler is called when the host halts or clears an endpoint,
+// see SetUSBEndpointHaltHandler.
+var usbEndpointHaltHandler func(addr uint8, halted bool)
+
+// SetUSBEndpointHaltHandler registers a function that is called from the USB
+// interrupt handler after the host sets or clears the halt feature of an
+// endpoint, for example for the error recovery of a class. The address
+// includes the direction bit (0x80 for IN endpoints). Clearing the halt
+// feature also resets the data toggle, even if the endpoint was not halted.
+func SetUSBEndpointHaltHandler(handler func(addr uint8, halted bool)) {
+	mask := interrupt.Disable()
+	usbEndpointHaltHandler = handler
+	interrupt.Restore(mask)
+}
+
+// hostSetEndpointHalt handles a SET_FEATURE or CLEAR_FEATURE request for the
+// halt feature of an endpoint.
+func hostSetEndpointHalt(addr uint16, halt bool) bool {
+	if !validEndpointAddress(addr) {
+		return false
+	}
+	setEndpointHalt(addr, halt)
+	if usbEndpointHaltHandler != nil {
+		usbEndpointHaltHandler(uint8(addr), halt)
+	}
+	return true
+}
+
+// getInterface returns the alternate setting of the interface in a
+// GET_INTERFACE request, or false if the request is invalid. None of the
+// interfaces has alternate settings, so it is always 0.
+func getInterface(setup usbSetup) (uint8, bool) {
+	if usbConfiguration == 0 || setup.wValueL != 0 || setup.wValueH != 0 || setup.wLength != 1 ||
+		setup.bmRequestType&usb_REQUEST_RECIPIENT != usb_REQUEST_INTERFACE ||
+		setup.wIndex >= usb_NUM_INTERFACES {
+		return 0, false
+	}
+	return 0, true
+}
+
+// setInterface handles a SET_INTERFACE request and returns whether it was
+// accepted. The configuration descriptor only has alternate setting 0, so
+// every other alternate setting is stalled.
+func setInterface(setup usbSetup) bool {
+	if usbConfiguration == 0 || setup.wValueH != 0 || setup.wValueL != 0 ||
+		setup.bmRequestType&usb_REQUEST_RECIPIENT != usb_REQUEST_INTERFACE ||
+		setup.wIndex >= usb_NUM_INTERFACES {
+		return false
+	}
+	return true
+}
+
+var (
+	// usbControlLength is the wLength of the control request that is being
+	// handled.
+	usbControlLength uint16
+
+	// usbNoZLP disables zero-length packets at the end of control IN
+	// transfers, see SetUSBZeroLengthPackets.
+	usbNoZLP bool
+)
+
+// SetUSBZeroLengthPackets sets whether control IN transfers whose length is a
+// multiple of the packet size, but shorter than what the host asked for, are
+// ended with a zero-length packet as the USB specification requires. This is
+// enabled by default and should only be disabled for hosts that do not handle
+// zero-length packets.
+func SetUSBZeroLengthPackets(enabled bool) {
+	usbNoZLP = !enabled
+}
+
+// controlNeedsZLP returns whether a control IN transfer of n bytes must be
+// ended with a zero-length packet, so the host knows it is complete.
+func controlNeedsZLP(n int) bool {
+	return !usbNoZLP && n > 0 && n%usbEndpointPacketSize == 0 && n < int(usbControlLength)
+}
+
+// USBControlRequest is a control request sent by the host on endpoint 0, as
+// passed to a USBControlHandler.
+type USBControlRequest struct {
+	RequestType uint8
+	Request     uint8
+	Value       uint16
+	Index       uint16
+	Length      uint16
+}
+
+// USBControlHandler handles a control request on endpoint 0. It is called from
+// the USB interrupt handler and must return quickly.
+//
+// For a device-to-host request, data is nil and the returned response is sent
+// to the host, truncated to the length the host asked for. A response that
+// does not fit in the 128 byte endpoint 0 buffer is sent straight from the
+// returned slice, which must then be word aligned (like the start of an
+// allocation) and must not be modified afterwards. For a host-to-device
+// request, data holds the data stage sent by the host (nil when there is none,
+// at most 64 bytes otherwise) and the response is ignored. Returning false
+// stalls the request.
+type USBControlHandler func(req USBControlRequest, data []byte) (response []byte, ok bool)
+
+// usbVendorHandler handles vendor requests, see SetUSBVendorHandler.
+var usbVendorHandler USBControlHandler
+
+// SetUSBVendorHandler registers a function that handles all vendor-type
+// control requests on endpoint 0, for example for WebUSB. Vendor requests are
+// stalled when no handler is registered.
+func SetUSBVendorHandler(handler USBControlHandler) {
+	mask := interrupt.Disable()
+	usbVendorHandler = handler
+	interrupt.Restore(mask)
+}
+
+// usbClassHandlers holds the handlers registered with SetUSBClassHandler,
+// keyed by interface number and bRequest.
+var usbClassHandlers map[[2]uint8]USBControlHandler
+
+// SetUSBClassHandler registers a function that handles the class-type control
+// requests with the given bRequest sent to the given interface, so that class
+// implementations can live outside this package. A registered handler takes
+// precedence over the built-in CDC handling. Passing a nil handler removes it.
+func SetUSBClassHandler(intf, request uint8, handler USBControlHandler) {
+	mask := interrupt.Disable()
+	if handler == nil {
+		delete(usbClassHandlers, [2]uint8{intf, request})
+	} else {
+		if usbClassHandlers == nil {
+			usbClassHandlers = make(map[[2]uint8]USBControlHandler)
+		}
+		usbClassHandlers[[2]uint8{intf, request}] = handler
+	}
+	interrupt.Restore(mask)
+}
+
+// classHandler returns the handler registered for a class request, or nil if
+// there is none.
+func classHandler(setup usbSetup) USBControlHandler {
+	if setup.bmRequestType&usb_REQUEST_TYPE != usb_REQUEST_CLASS ||
+		setup.bmRequestType&usb_REQUEST_RECIPIENT != usb_REQUEST_INTERFACE ||
+		setup.wIndex > 0xff {
+		return nil
+	}
+	return usbClassHandlers[[2]uint8{uint8(setup.wIndex), setup.bRequest}]
+}
+
+// controlRequest returns the exported form of a setup packet.
+func (setup usbSetup) controlRequest() USBControlRequest {
+	return USBControlRequest{
+		RequestType: setup.bmRequestType,
+		Request:     setup.bRequest,
+		Value:       uint16(setup.wValueH)<<8 | uint16(setup.wValueL),
+		Index:       setup.wIndex,
+		Length:      setup.wLength,
+	}
+}
+
+// controlResponse calls the handler for a device-to-host request and returns
+// the response to send, or false if the request must be stalled.
+func controlResponse(setup usbSetup, handler USBControlHandler) ([]byte, bool) {
+	b, ok := handler(setup.controlRequest(), nil)
+	if !ok {
+		return nil, false
+	}
+	b = truncateControlData(b, setup.wLength)
+	if len(b) > len(udd_ep_in_cache_buffer[0]) && uintptr(unsafe.Pointer(&b[0]))%4 != 0 {
+		// too long for the endpoint 0 buffer, and cannot be sent directly
+		return nil, false
+	}
+	return b, true
+}
+
+// usbControlData keeps the data of a control IN transfer that is sent straight
+// from memory alive until the transfer is complete.
+var usbControlData []byte
+
+// sendControlData sends the data stage of a control IN request. Data that does
+// not fit in the endpoint 0 buffer is sent straight from b, which must then be
+// word aligned.
+func sendControlData(b []byte) {
+	if len(b) > len(udd_ep_in_cache_buffer[0]) {
+		usbControlData = b
+		sendUSBControlData(b)
+	} else {
+		usbControlData = nil
+		sendUSBPacket(0, b)
+	}
+}
+
+// USBDetach disconnects the device from the bus by removing the pull-up on D+,
+// so the host sees it as unplugged. Together with USBAttach this makes the
+// host enumerate the device again, for example after changing its descriptors.
+func USBDetach() {
+	mask := interrupt.Disable()
+	setUSBPullup(false)
+	usbConfiguration = 0
+	usbSuspended = false
+	setUSBState(USBStateDefault)
+	interrupt.Restore(mask)
+}
+
+// USBAttach connects the device to the bus again after USBDetach.
+func USBAttach() {
+	setUSBPullup(true)
+}
+
+// usbSOFHandler is called on every start-of-frame, see SetUSBSOFHandler.
+var usbSOFHandler func(frame uint16)
+
+// SetUSBSOFHandler registers a function that is called from the USB interrupt
+// handler on every start-of-frame, once per millisecond while the bus is
+// active, with the 11-bit frame number sent by the host. It can be used for
+// clock recovery or to synchronize sampling with the host, and must return
+// quickly.
+func SetUSBSOFHandler(handler func(frame uint16)) {
+	mask := interrupt.Disable()
+	usbSOFHandler = handler
+	interrupt.Restore(mask)
+}
+
+// USBState is the state of the USB device, as set by the host.
+type USBState uint8
+
+const (
+	USBStateDefault    USBState = iota // after a bus reset
+	USBStateAddressed                  // the host has assigned an address
+	USBStateConfigured                 // the host has selected a configuration
+	USBStateSuspended                  // the host has suspended the bus
+)
+
+var (
+	// usbState is the state of the device, not counting suspend.
+	usbState USBState
+
+	// usbSuspended is set while the host has suspended the bus.
+	usbSuspended bool
+
+	// usbStateHandler is called on state changes, see SetUSBStateHandler.
+	usbStateHandler func(USBState)
+)
+
+// USBDeviceState returns the current state of the USB device.
+func USBDeviceState() USBState {
+	if usbSuspended {
+		return USBStateSuspended
+	}
+	return usbState
+}
+
+// SetUSBStateHandler registers a function that is called from the USB
+// interrupt handler when the state of the USB device changes, for example to
+// defer work until the device is configured or to save power while it is
+// suspended. When the bus resumes the handler is called with the state from
+// before the suspend.
+func SetUSBStateHandler(handler func(state USBState)) {
+	mask := interrupt.Disable()
+	usbStateHandler = handler
+	interrupt.Restore(mask)
+}
+
+// setUSBState changes the state of the device and notifies the handler.
+func setUSBState(state USBState) {
+	usbState = state
+	if usbStateHandler != nil && !usbSuspended {
+		usbStateHandler(state)
+	}
+}
+
+// setUSBSuspended updates the suspend state of the bus and notifies the
+// handler.
+func setUSBSuspended(suspended bool) {
+	if suspended == usbSuspended {
+		return
+	}
+	usbSuspended = suspended
+	if usbStateHandler != nil {
+		usbStateHandler(USBDeviceState())
+	}
+}
+
+// USBWakeup signals remote wakeup to the host while the bus is suspended, for
+// example when a key is pressed on a keyboard. It does nothing when the bus is
+// not suspended, and returns an error when the host has not enabled remote
+// wakeup.
+func USBWakeup() error {
+	if !usbSuspended {
+		return nil
+	}
+	if !isRemoteWakeUpEnabled {
+		return errUSBWakeupDisabled
+	}
+	sendRemoteWakeup()
+	return nil
+}
+
+// deviceStatus returns the first byte of the GET_STATUS response for the
+// device.
+func deviceStatus() uint8 {
+	var status uint8
+	if usbSelfPowered {
+		status |= 1
+	}
+	if isRemoteWakeUpEnabled {
+		status |= 1 << usb_FEATURE_DEVICE_REMOTE_WAKEUP
+	}
+	return status
 }
 
 // USBCDC is the serial interface that works over the USB port.
@@ -626,7 +1090,11 @@ func (usbcdc *USBCDC) Read(data []byte) (n int, err error) {
 	return size, nil
 }
 
-// Write data to the USBCDC.
+// Write data to the USBCDC. WriteByte waits for room in the endpoint buffer
+// without yielding to the scheduler, so with the cooperative scheduler no
+// other goroutine runs during a Write call and the data of one call is never
+// interleaved with that of another. Data written from an interrupt handler
+// can still end up in the middle of it.
 func (usbcdc *USBCDC) Write(data []byte) (n int, err error) {
 	for _, v := range data {
 		usbcdc.WriteByte(v)
@@ -642,6 +1110,10 @@ func (usbcdc *USBCDC) ReadByte() (byte, error) {
 	if !ok {
 		return 0, errUSBCDCBufferEmpty
 	}
+	if usbcdc.rxPending {
+		// there may be room for the data held back in the endpoint now
+		usbcdc.receivePending()
+	}
 	return buf, nil
 }
 
@@ -656,100 +1128,224 @@ func (usbcdc *USBCDC) Receive(data byte) {
 	usbcdc.Buffer.Put(data)
 }
 
+// SetSerialState reports the state of the (virtual) UART to the host, using a
+// SERIAL_STATE notification on the CDC interrupt endpoint. The state is a
+// combination of the USBCDCSerialState* bits. The error and break bits are
+// events: send them once, then send the state again without them.
+// Notifications are only sent while the host has the port open.
+func (usbcdc *USBCDC) SetSerialState(state uint16) {
+	if usbConfiguration == 0 || usbLineInfo.lineState == 0 {
+		return
+	}
+
+	b := [cdcSerialStateSize]byte{
+		usb_REQUEST_DEVICETOHOST_CLASS_INTERFACE,
+		usb_CDC_SERIAL_STATE,
+		0, 0, // wValue
+		usb_CDC_ACM_INTERFACE, 0, // wIndex
+		2, 0, // wLength
+		byte(state), byte(state >> 8),
+	}
+	sendCDCNotification(b[:])
+}
+
 // sendDescriptor creates and sends the various USB descriptor types that
-// can be requested by the host.
-func sendDescriptor(setup usbSetup) {
+// can be requested by the host. It returns false when the requested descriptor
+// does not exist, in which case the request must be stalled.
+func sendDescriptor(setup usbSetup) bool {
 	switch setup.wValueH {
 	case usb_CONFIGURATION_DESCRIPTOR_TYPE:
 		sendConfiguration(setup)
-		return
+		return true
 	case usb_DEVICE_DESCRIPTOR_TYPE:
 		// composite descriptor
-		dd := NewDeviceDescriptor(0xef, 0x02, 0x01, 64, usb_VID, usb_PID, 0x100, usb_IMANUFACTURER, usb_IPRODUCT, usb_ISERIAL, 1)
-		l := deviceDescriptorSize
-		if setup.wLength < deviceDescriptorSize {
-			l = int(setup.wLength)
+		var iSerial uint8
+		if usbStringSerial != "" {
+			iSerial = usb_ISERIAL
+		}
+		dd := NewDeviceDescriptor(0xef, 0x02, 0x01, 64, usb_VID, usb_PID, usb_BCD_DEVICE, usb_IMANUFACTURER, usb_IPRODUCT, iSerial, usb_NUM_CONFIGURATIONS)
+		if len(usbCapabilities) != 0 {
+			// hosts only ask for the BOS descriptor from USB 2.01 devices
+			dd.bcdUSB = 0x201
 		}
 		buf := dd.Bytes()
-		sendUSBPacket(0, buf[:l])
-		return
+		sendUSBPacket(0, truncateControlData(buf[:], setup.wLength))
+		return true
 
 	case usb_STRING_DESCRIPTOR_TYPE:
-		switch setup.wValueL {
-		case 0:
-			b := []byte{0x04, 0x03, 0x09, 0x04}
-			sendUSBPacket(0, b)
-
-		case usb_IPRODUCT:
-			b := make([]byte, (len(usb_STRING_PRODUCT)<<1)+2)
-			strToUTF16LEDescriptor(usb_STRING_PRODUCT, b)
-			sendUSBPacket(0, b)
-
-		case usb_IMANUFACTURER:
-			b := make([]byte, (len(usb_STRING_MANUFACTURER)<<1)+2)
-			strToUTF16LEDescriptor(usb_STRING_MANUFACTURER, b)
-			sendUSBPacket(0, b)
-
-		case usb_ISERIAL:
-			// TODO: allow returning a product serial number
-			sendZlp()
+		return sendStringDescriptor(setup)
+
+	case usb_BOS_DESCRIPTOR_TYPE:
+		return sendBOS(setup)
+
+	case usb_DEVICE_QUALIFIER, usb_OTHER_SPEED_CONFIGURATION:
+		// These only exist for high-speed capable devices. All supported
+		// chips are full speed only, and a full speed device must answer
+		// them with a request error.
+		return false
+	}
+
+	// unknown descriptor type
+	return false
+}
+
+// Device capability types, for use with AddUSBDeviceCapability.
+const (
+	USBCapabilityUSB20Extension = 0x02
+	USBCapabilitySuperSpeed     = 0x03
+	USBCapabilityPlatform       = 0x05
+)
+
+const bosDescriptorSize = 5
+
+// usbCapabilities holds the device capability descriptors that are sent as
+// part of the BOS descriptor.
+var usbCapabilities [][]byte
+
+// AddUSBDeviceCapability adds a device capability descriptor with the given
+// type to the BOS descriptor. The data is the part of the descriptor after
+// bDevCapabilityType, for example the platform capability UUID followed by
+// its data for WebUSB. Once a capability is added the device reports itself as
+// USB 2.01, so the host asks for the BOS descriptor. The runtime configures USB
+// before main runs, so the capability is only seen by the host the next time
+// it enumerates the device. Call USBDetach and then USBAttach to force that.
+func AddUSBDeviceCapability(capabilityType uint8, data []byte) error {
+	c := make([]byte, 3+len(data))
+	c[0] = byte(len(c))
+	c[1] = usb_DEVICE_CAPABILITY_TYPE
+	c[2] = capabilityType
+	copy(c[3:], data)
+
+	mask := interrupt.Disable()
+	size := bosDescriptorSize + len(c)
+	for _, other := range usbCapabilities {
+		size += len(other)
+	}
+	if size > len(udd_ep_in_cache_buffer[0]) {
+		interrupt.Restore(mask)
+		return errUSBCapabilitySize
+	}
+	usbCapabilities = append(usbCapabilities, c)
+	interrupt.Restore(mask)
+	return nil
+}
+
+// sendBOS sends the BOS descriptor with all device capabilities, or returns
+// false if there are none.
+func sendBOS(setup usbSetup) bool {
+	if len(usbCapabilities) == 0 {
+		return false
+	}
+
+	b := make([]byte, bosDescriptorSize, len(udd_ep_in_cache_buffer[0]))
+	for _, c := range usbCapabilities {
+		b = append(b, c...)
+	}
+	b[0] = bosDescriptorSize
+	b[1] = usb_BOS_DESCRIPTOR_TYPE
+	b[2] = byte(len(b))
+	b[3] = byte(len(b) >> 8)
+	b[4] = byte(len(usbCapabilities))
+
+	sendUSBPacket(0, truncateControlData(b, setup.wLength))
+	return true
+}
+
+// usbString returns the string for the given string descriptor index and
+// language ID, or false if there is no such string.
+func usbString(index uint8, langID uint16) (string, bool) {
+	def := usbLanguage{
+		langID:       usb_LANGID_DEFAULT,
+		manufacturer: usbStringManufacturer,
+		product:      usbStringProduct,
+		serial:       usbStringSerial,
+		extra:        usbExtraStrings,
+	}
+	return lookupUSBString(def, usbLanguages, index, langID)
+}
+
+// sendStringDescriptor sends the string descriptor the host asked for. Both the
+// index and the language ID come straight from the host, so they are checked
+// here and false is returned for anything this device does not have.
+func sendStringDescriptor(setup usbSetup) bool {
+	var b []byte
+	if setup.wValueL == 0 {
+		// list of supported languages, the default language first
+		b = make([]byte, 4+2*len(usbLanguages))
+		b[0] = byte(len(b))
+		b[1] = usb_STRING_DESCRIPTOR_TYPE
+		b[2] = byte(usb_LANGID_DEFAULT & 0xff)
+		b[3] = byte(usb_LANGID_DEFAULT >> 8)
+		for i, lang := range usbLanguages {
+			b[4+2*i] = byte(lang.langID)
+			b[5+2*i] = byte(lang.langID >> 8)
 		}
-		return
+	} else {
+		// Language ID 0 is accepted as the default language, some hosts use
+		// it when they did not read the list of languages first.
+		str, ok := usbString(setup.wValueL, setup.wIndex)
+		if !ok {
+			return false
+		}
+		b = make([]byte, utf16LEDescriptorSize(str))
+		strToUTF16LEDescriptor(str, b)
+		b = b[:b[0]]
 	}
 
-	// do not know how to handle this message, so return zero
-	sendZlp()
-	return
+	b = truncateControlData(b, setup.wLength)
+	// b comes from make, so it is word aligned if it has to be sent directly
+	sendControlData(b)
+	return true
 }
 
 // sendConfiguration creates and sends the configuration packet to the host.
+// Only the first wLength bytes are sent: hosts usually ask for the 9 byte
+// configuration descriptor first to learn wTotalLength, and then for the whole
+// set.
 func sendConfiguration(setup usbSetup) {
-	if setup.wLength == 9 {
-		sz := uint16(configDescriptorSize + cdcSize)
-		config := NewConfigDescriptor(sz, 2)
-		configBuf := config.Bytes()
-		sendUSBPacket(0, configBuf[:])
-	} else {
-		iad := NewIADDescriptor(0, 2, usb_CDC_COMMUNICATION_INTERFACE_CLASS, usb_CDC_ABSTRACT_CONTROL_MODEL, 0)
+	iad := NewIADDescriptor(0, 2, usb_CDC_COMMUNICATION_INTERFACE_CLASS, usb_CDC_ABSTRACT_CONTROL_MODEL, 0)
 
-		cif := NewInterfaceDescriptor(usb_CDC_ACM_INTERFACE, 1, usb_CDC_COMMUNICATION_INTERFACE_CLASS, usb_CDC_ABSTRACT_CONTROL_MODEL, 0)
+	cif := NewInterfaceDescriptor(usb_CDC_ACM_INTERFACE, 1, usb_CDC_COMMUNICATION_INTERFACE_CLASS, usb_CDC_ABSTRACT_CONTROL_MODEL, 0)
 
-		header := NewCDCCSInterfaceDescriptor(usb_CDC_HEADER, usb_CDC_V1_10&0xFF, (usb_CDC_V1_10>>8)&0x0FF)
+	header := NewCDCCSInterfaceDescriptor(usb_CDC_HEADER, usb_CDC_V1_10&0xFF, (usb_CDC_V1_10>>8)&0x0FF)
 
-		controlManagement := NewACMFunctionalDescriptor(usb_CDC_ABSTRACT_CONTROL_MANAGEMENT, 6)
+	controlManagement := NewACMFunctionalDescriptor(usb_CDC_ABSTRACT_CONTROL_MANAGEMENT, 6)
 
-		functionalDescriptor := NewCDCCSInterfaceDescriptor(usb_CDC_UNION, usb_CDC_ACM_INTERFACE, usb_CDC_DATA_INTERFACE)
+	functionalDescriptor := NewCDCCSInterfaceDescriptor(usb_CDC_UNION, usb_CDC_ACM_INTERFACE, usb_CDC_DATA_INTERFACE)
 
-		callManagement := NewCMFunctionalDescriptor(usb_CDC_CALL_MANAGEMENT, 1, 1)
+	callManagement := NewCMFunctionalDescriptor(usb_CDC_CALL_MANAGEMENT, 1, 1)
 
-		cifin := NewEndpointDescriptor((usb_CDC_ENDPOINT_ACM | usbEndpointIn), usb_ENDPOINT_TYPE_INTERRUPT, 0x10, 0x10)
+	cifin := NewEndpointDescriptor((usb_CDC_ENDPOINT_ACM | usbEndpointIn), usb_ENDPOINT_TYPE_INTERRUPT, 0x10, 0x10)
 
-		dif := NewInterfaceDescriptor(usb_CDC_DATA_INTERFACE, 2, usb_CDC_DATA_INTERFACE_CLASS, 0, 0)
+	dif := NewInterfaceDescriptor(usb_CDC_DATA_INTERFACE, 2, usb_CDC_DATA_INTERFACE_CLASS, 0, 0)
 
-		out := NewEndpointDescriptor((usb_CDC_ENDPOINT_OUT | usbEndpointOut), usb_ENDPOINT_TYPE_BULK, usbEndpointPacketSize, 0)
+	out := NewEndpointDescriptor((usb_CDC_ENDPOINT_OUT | usbEndpointOut), usb_ENDPOINT_TYPE_BULK, usbEndpointPacketSize, 0)
 
-		in := NewEndpointDescriptor((usb_CDC_ENDPOINT_IN | usbEndpointIn), usb_ENDPOINT_TYPE_BULK, usbEndpointPacketSize, 0)
+	in := NewEndpointDescriptor((usb_CDC_ENDPOINT_IN | usbEndpointIn), usb_ENDPOINT_TYPE_BULK, usbEndpointPacketSize, 0)
 
-		cdc := NewCDCDescriptor(iad,
-			cif,
-			header,
-			controlManagement,
-			functionalDescriptor,
-			callManagement,
-			cifin,
-			dif,
-			out,
-			in)
+	cdc := NewCDCDescriptor(iad,
+		cif,
+		header,
+		controlManagement,
+		functionalDescriptor,
+		callManagement,
+		cifin,
+		dif,
+		out,
+		in)
 
-		sz := uint16(configDescriptorSize + cdcSize)
-		config := NewConfigDescriptor(sz, 2)
+	sz := uint16(configDescriptorSize + cdcSize)
+	config := NewConfigDescriptor(sz, 2)
+	if usbSelfPowered {
+		config.bmAttributes = usb_CONFIG_SELF_POWERED | usb_CONFIG_REMOTE_WAKEUP
+	}
+	config.bMaxPower = usbMaxPower
 
-		configBuf := config.Bytes()
-		cdcBuf := cdc.Bytes()
-		var buf [configDescriptorSize + cdcSize]byte
-		copy(buf[0:], configBuf[:])
-		copy(buf[configDescriptorSize:], cdcBuf[:])
+	configBuf := config.Bytes()
+	cdcBuf := cdc.Bytes()
+	var buf [configDescriptorSize + cdcSize]byte
+	copy(buf[0:], configBuf[:])
+	copy(buf[configDescriptorSize:], cdcBuf[:])
 
-		sendUSBPacket(0, buf[:])
-	}
+	sendUSBPacket(0, truncateControlData(buf[:], setup.wLength))
 }
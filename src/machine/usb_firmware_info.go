@@ -0,0 +1,78 @@
+//go:build sam || nrf52840
+// +build sam nrf52840
+
+package machine
+
+import "errors"
+
+var errUSBFirmwareInfoSize = errors.New("USB firmware info does not fit in the endpoint 0 buffer")
+
+// USBFirmwareInfo is the firmware metadata reported by the handler returned by
+// USBFirmwareInfoHandler.
+type USBFirmwareInfo struct {
+	Version string // firmware version, for example "1.2.0"
+	BuildID []byte // for example the commit hash the firmware was built from
+	ChipID  []byte // unique ID of the chip, as read by the application
+
+	// Uptime returns the time since boot in seconds. It is called from the
+	// USB interrupt handler. When it is nil the uptime is reported as 0.
+	Uptime func() uint32
+}
+
+const usbFirmwareInfoHeaderSize = 8
+
+// USBFirmwareInfoHandler returns a vendor request handler that reports info to
+// the host, so that devices can be inventoried over USB without a serial
+// protocol. The handler answers the device-to-host vendor request with the
+// given bRequest (bmRequestType 0xC0, wValue and wIndex 0) and stalls every
+// other request. It can be registered with SetUSBVendorHandler directly, or be
+// called from a vendor handler of the application.
+//
+// The response has the following format, with all numbers little endian:
+//
+//	offset  size  field
+//	0       1     format version, currently 1
+//	1       1     length of Version (v)
+//	2       1     length of BuildID (b)
+//	3       1     length of ChipID (c)
+//	4       4     uptime in seconds
+//	8       v     Version, UTF-8
+//	8+v     b     BuildID
+//	8+v+b   c     ChipID
+//
+// The whole response must fit in the 128 byte endpoint 0 buffer, an error is
+// returned otherwise. Hosts should ask for 128 bytes.
+func USBFirmwareInfoHandler(request uint8, info USBFirmwareInfo) (USBControlHandler, error) {
+	size := usbFirmwareInfoHeaderSize + len(info.Version) + len(info.BuildID) + len(info.ChipID)
+	if size > len(udd_ep_in_cache_buffer[0]) {
+		return nil, errUSBFirmwareInfoSize
+	}
+
+	b := make([]byte, usbFirmwareInfoHeaderSize, size)
+	b[0] = 1
+	b[1] = byte(len(info.Version))
+	b[2] = byte(len(info.BuildID))
+	b[3] = byte(len(info.ChipID))
+	b = append(b, info.Version...)
+	b = append(b, info.BuildID...)
+	b = append(b, info.ChipID...)
+	uptime := info.Uptime
+
+	return func(req USBControlRequest, data []byte) ([]byte, bool) {
+		if req.RequestType != usb_REQUEST_DEVICETOHOST|usb_REQUEST_VENDOR|usb_REQUEST_DEVICE ||
+			req.Request != request || req.Value != 0 || req.Index != 0 {
+			return nil, false
+		}
+		// The response is copied into the endpoint 0 buffer, so b can be
+		// updated for the next request right away.
+		var seconds uint32
+		if uptime != nil {
+			seconds = uptime()
+		}
+		b[4] = byte(seconds)
+		b[5] = byte(seconds >> 8)
+		b[6] = byte(seconds >> 16)
+		b[7] = byte(seconds >> 24)
+		return b, true
+	}, nil
+}
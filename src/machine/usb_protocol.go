@@ -0,0 +1,262 @@
+package machine
+
+// This file holds the parts of the USB stack that do not touch the hardware,
+// so that they can be tested on the host. The rest is in usb.go.
+
+const (
+	usb_IMANUFACTURER = 1
+	usb_IPRODUCT      = 2
+	usb_ISERIAL       = 3
+
+	usb_DEVICE_DESCRIPTOR_TYPE        = 1
+	usb_CONFIGURATION_DESCRIPTOR_TYPE = 2
+	usb_STRING_DESCRIPTOR_TYPE        = 3
+	usb_INTERFACE_DESCRIPTOR_TYPE     = 4
+	usb_ENDPOINT_DESCRIPTOR_TYPE      = 5
+	usb_DEVICE_QUALIFIER              = 6
+	usb_OTHER_SPEED_CONFIGURATION     = 7
+	usb_BOS_DESCRIPTOR_TYPE           = 15
+	usb_DEVICE_CAPABILITY_TYPE        = 16
+
+	usbEndpointOut = 0x00
+	usbEndpointIn  = 0x80
+
+	// standard requests
+	usb_GET_STATUS        = 0
+	usb_CLEAR_FEATURE     = 1
+	usb_SET_FEATURE       = 3
+	usb_SET_ADDRESS       = 5
+	usb_GET_DESCRIPTOR    = 6
+	usb_SET_DESCRIPTOR    = 7
+	usb_GET_CONFIGURATION = 8
+	usb_SET_CONFIGURATION = 9
+	usb_GET_INTERFACE     = 10
+	usb_SET_INTERFACE     = 11
+	usb_SYNCH_FRAME       = 12
+
+	// standard feature selectors
+	usb_FEATURE_ENDPOINT_HALT        = 0
+	usb_FEATURE_DEVICE_REMOTE_WAKEUP = 1
+
+	// bmRequestType
+	usb_REQUEST_HOSTTODEVICE = 0x00
+	usb_REQUEST_DEVICETOHOST = 0x80
+	usb_REQUEST_DIRECTION    = 0x80
+
+	usb_REQUEST_STANDARD = 0x00
+	usb_REQUEST_CLASS    = 0x20
+	usb_REQUEST_VENDOR   = 0x40
+	usb_REQUEST_TYPE     = 0x60
+
+	usb_REQUEST_DEVICE    = 0x00
+	usb_REQUEST_INTERFACE = 0x01
+	usb_REQUEST_ENDPOINT  = 0x02
+	usb_REQUEST_OTHER     = 0x03
+	usb_REQUEST_RECIPIENT = 0x1F
+
+	usb_REQUEST_DEVICETOHOST_CLASS_INTERFACE    = (usb_REQUEST_DEVICETOHOST | usb_REQUEST_CLASS | usb_REQUEST_INTERFACE)
+	usb_REQUEST_HOSTTODEVICE_CLASS_INTERFACE    = (usb_REQUEST_HOSTTODEVICE | usb_REQUEST_CLASS | usb_REQUEST_INTERFACE)
+	usb_REQUEST_DEVICETOHOST_STANDARD_INTERFACE = (usb_REQUEST_DEVICETOHOST | usb_REQUEST_STANDARD | usb_REQUEST_INTERFACE)
+)
+
+// typedef struct {
+// 	union {
+// 		uint8_t bmRequestType;
+// 		struct {
+// 			uint8_t direction : 5;
+// 			uint8_t type : 2;
+// 			uint8_t transferDirection : 1;
+// 		};
+// 	};
+// 	uint8_t bRequest;
+// 	uint8_t wValueL;
+// 	uint8_t wValueH;
+// 	uint16_t wIndex;
+// 	uint16_t wLength;
+// } USBSetup;
+type usbSetup struct {
+	bmRequestType uint8
+	bRequest      uint8
+	wValueL       uint8
+	wValueH       uint8
+	wIndex        uint16
+	wLength       uint16
+}
+
+func newUSBSetup(data []byte) usbSetup {
+	u := usbSetup{}
+	u.bmRequestType = uint8(data[0])
+	u.bRequest = uint8(data[1])
+	u.wValueL = uint8(data[2])
+	u.wValueH = uint8(data[3])
+	u.wIndex = uint16(data[4]) | (uint16(data[5]) << 8)
+	u.wLength = uint16(data[6]) | (uint16(data[7]) << 8)
+	return u
+}
+
+// truncateControlData returns the part of a control IN response that is sent
+// to the host: never more than the wLength the host asked for.
+func truncateControlData(b []byte, wLength uint16) []byte {
+	if int(wLength) < len(b) {
+		return b[:wLength]
+	}
+	return b
+}
+
+// validStandardSetup returns whether the direction and length of a standard
+// request match the request itself. A request that gets this wrong would
+// otherwise be answered with a data stage in a direction the host does not
+// expect.
+func validStandardSetup(setup usbSetup) bool {
+	in := setup.bmRequestType&usb_REQUEST_DIRECTION == usb_REQUEST_DEVICETOHOST
+	switch setup.bRequest {
+	case usb_GET_STATUS, usb_GET_DESCRIPTOR, usb_GET_CONFIGURATION, usb_GET_INTERFACE, usb_SYNCH_FRAME:
+		return in
+	case usb_CLEAR_FEATURE, usb_SET_FEATURE, usb_SET_ADDRESS, usb_SET_CONFIGURATION, usb_SET_INTERFACE:
+		return !in && setup.wLength == 0
+	case usb_SET_DESCRIPTOR:
+		return !in
+	default:
+		return true
+	}
+}
+
+// endpointHaltBit returns the bit in usbEndpointHalt for the given endpoint
+// address.
+func endpointHaltBit(addr uint16) uint16 {
+	if addr&usbEndpointIn != 0 {
+		return 1 << (8 + addr&0x0f)
+	}
+	return 1 << (addr & 0x0f)
+}
+
+// endpointHaltAddress is the inverse of endpointHaltBit: it returns the
+// endpoint address for bit n of usbEndpointHalt.
+func endpointHaltAddress(n uint16) uint16 {
+	if n >= 8 {
+		return usbEndpointIn | (n - 8)
+	}
+	return n
+}
+
+// maxStringDescriptorSize is the largest even size that fits in the one byte
+// bLength field of a string descriptor.
+const maxStringDescriptorSize = 254
+
+// utf16LEDescriptorSize returns the size of the string descriptor for the given
+// utf8 string, including the two byte header. A string that is too long is cut
+// off after the last character that fits whole, so that a surrogate pair is
+// never split.
+func utf16LEDescriptorSize(in string) int {
+	n := 2
+	for _, r := range in {
+		size := 2
+		if r >= 0x10000 {
+			// needs a surrogate pair
+			size = 4
+		}
+		if n+size > maxStringDescriptorSize {
+			break
+		}
+		n += size
+	}
+	return n
+}
+
+// strToUTF16LEDescriptor converts a utf8 string into a string descriptor. The
+// out slice should be utf16LEDescriptorSize(in) bytes long, characters that do
+// not fit whole are dropped and bLength is set to the encoded size.
+// note: the conversion is done by hand instead of using the 'unicode/utf16'
+// package, which at the time this was written added 512 bytes to the compiled
+// binary.
+func strToUTF16LEDescriptor(in string, out []byte) {
+	out[1] = usb_STRING_DESCRIPTOR_TYPE
+	i := 2
+	for _, r := range in {
+		if r >= 0x10000 {
+			if i+4 > len(out) {
+				break
+			}
+			r -= 0x10000
+			hi := 0xd800 + (r>>10)&0x3ff
+			lo := 0xdc00 + r&0x3ff
+			out[i] = byte(hi)
+			out[i+1] = byte(hi >> 8)
+			out[i+2] = byte(lo)
+			out[i+3] = byte(lo >> 8)
+			i += 4
+		} else {
+			if i+2 > len(out) {
+				break
+			}
+			out[i] = byte(r)
+			out[i+1] = byte(r >> 8)
+			i += 2
+		}
+	}
+	// bLength covers whole characters only
+	out[0] = byte(i)
+	return
+}
+
+// usb_LANGID_DEFAULT is the language of the strings in USBDeviceConfig and
+// SetUSBString: US English.
+const usb_LANGID_DEFAULT = 0x0409
+
+// usbLanguage holds the strings of one language, see AddUSBLanguage.
+type usbLanguage struct {
+	langID       uint16
+	manufacturer string
+	product      string
+	serial       string
+	extra        map[uint8]string
+}
+
+// get returns the string with the given index, or "" if it is not set.
+func (l *usbLanguage) get(index uint8) string {
+	switch index {
+	case usb_IPRODUCT:
+		return l.product
+	case usb_IMANUFACTURER:
+		return l.manufacturer
+	case usb_ISERIAL:
+		return l.serial
+	default:
+		return l.extra[index]
+	}
+}
+
+// lookupUSBString returns the string for the given string descriptor index and
+// language ID, or false if there is no such string. Strings that are missing
+// in another language fall back to def, the strings in the default language.
+// Language ID 0 is accepted as the default language, some hosts use it when
+// they did not read the list of languages first.
+func lookupUSBString(def usbLanguage, languages []usbLanguage, index uint8, langID uint16) (string, bool) {
+	if langID != def.langID && langID != 0 {
+		found := false
+		for i := range languages {
+			if languages[i].langID == langID {
+				if str := languages[i].get(index); str != "" {
+					return str, true
+				}
+				found = true
+				break
+			}
+		}
+		if !found {
+			return "", false
+		}
+	}
+
+	switch index {
+	case usb_IPRODUCT:
+		return def.product, true
+	case usb_IMANUFACTURER:
+		return def.manufacturer, true
+	case usb_ISERIAL:
+		return def.serial, def.serial != ""
+	default:
+		str, ok := def.extra[index]
+		return str, ok
+	}
+}
@@ -0,0 +1,191 @@
+package machine
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidStandardSetup(t *testing.T) {
+	const in = usb_REQUEST_DEVICETOHOST
+	const out = usb_REQUEST_HOSTTODEVICE
+	tests := []struct {
+		name  string
+		setup usbSetup
+		want  bool
+	}{
+		{"GET_STATUS in", usbSetup{bmRequestType: in, bRequest: usb_GET_STATUS, wLength: 2}, true},
+		{"GET_STATUS out", usbSetup{bmRequestType: out, bRequest: usb_GET_STATUS, wLength: 2}, false},
+		{"GET_DESCRIPTOR in", usbSetup{bmRequestType: in, bRequest: usb_GET_DESCRIPTOR, wLength: 18}, true},
+		{"GET_DESCRIPTOR out", usbSetup{bmRequestType: out, bRequest: usb_GET_DESCRIPTOR, wLength: 18}, false},
+		{"GET_CONFIGURATION out", usbSetup{bmRequestType: out, bRequest: usb_GET_CONFIGURATION, wLength: 1}, false},
+		{"GET_INTERFACE out", usbSetup{bmRequestType: out | usb_REQUEST_INTERFACE, bRequest: usb_GET_INTERFACE, wLength: 1}, false},
+		{"SYNCH_FRAME in", usbSetup{bmRequestType: in | usb_REQUEST_ENDPOINT, bRequest: usb_SYNCH_FRAME, wLength: 2}, true},
+		{"SET_ADDRESS out", usbSetup{bmRequestType: out, bRequest: usb_SET_ADDRESS, wValueL: 5}, true},
+		{"SET_ADDRESS in", usbSetup{bmRequestType: in, bRequest: usb_SET_ADDRESS, wValueL: 5}, false},
+		{"SET_ADDRESS with data", usbSetup{bmRequestType: out, bRequest: usb_SET_ADDRESS, wValueL: 5, wLength: 1}, false},
+		{"SET_CONFIGURATION out", usbSetup{bmRequestType: out, bRequest: usb_SET_CONFIGURATION, wValueL: 1}, true},
+		{"SET_CONFIGURATION with data", usbSetup{bmRequestType: out, bRequest: usb_SET_CONFIGURATION, wValueL: 1, wLength: 8}, false},
+		{"CLEAR_FEATURE in", usbSetup{bmRequestType: in | usb_REQUEST_ENDPOINT, bRequest: usb_CLEAR_FEATURE}, false},
+		{"SET_FEATURE out", usbSetup{bmRequestType: out | usb_REQUEST_ENDPOINT, bRequest: usb_SET_FEATURE}, true},
+		{"SET_INTERFACE with data", usbSetup{bmRequestType: out | usb_REQUEST_INTERFACE, bRequest: usb_SET_INTERFACE, wLength: 1}, false},
+		{"SET_DESCRIPTOR out", usbSetup{bmRequestType: out, bRequest: usb_SET_DESCRIPTOR, wLength: 18}, true},
+		{"SET_DESCRIPTOR in", usbSetup{bmRequestType: in, bRequest: usb_SET_DESCRIPTOR, wLength: 18}, false},
+		{"unknown request", usbSetup{bmRequestType: in, bRequest: 0x7f, wLength: 4}, true},
+	}
+	for _, tc := range tests {
+		if got := validStandardSetup(tc.setup); got != tc.want {
+			t.Errorf("%s: validStandardSetup() = %v; want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestNewUSBSetup(t *testing.T) {
+	got := newUSBSetup([]byte{0x80, 0x06, 0x03, 0x02, 0x09, 0x04, 0xff, 0x00})
+	want := usbSetup{
+		bmRequestType: 0x80,
+		bRequest:      usb_GET_DESCRIPTOR,
+		wValueL:       0x03,
+		wValueH:       0x02,
+		wIndex:        0x0409,
+		wLength:       0xff,
+	}
+	if got != want {
+		t.Errorf("newUSBSetup() = %+v; want %+v", got, want)
+	}
+}
+
+func TestEndpointHaltBit(t *testing.T) {
+	tests := []struct {
+		addr uint16
+		want uint16
+	}{
+		{0x00, 1 << 0},
+		{0x02, 1 << 2},
+		{0x07, 1 << 7},
+		{0x80, 1 << 8},
+		{0x81, 1 << 9},
+		{0x83, 1 << 11},
+		{0x87, 1 << 15},
+	}
+	for _, tc := range tests {
+		if got := endpointHaltBit(tc.addr); got != tc.want {
+			t.Errorf("endpointHaltBit(%#x) = %#x; want %#x", tc.addr, got, tc.want)
+		}
+	}
+	for n := uint16(0); n < 16; n++ {
+		if got := endpointHaltBit(endpointHaltAddress(n)); got != 1<<n {
+			t.Errorf("endpointHaltBit(endpointHaltAddress(%d)) = %#x; want %#x", n, got, uint16(1)<<n)
+		}
+	}
+}
+
+func TestTruncateControlData(t *testing.T) {
+	tests := []struct {
+		size    int
+		wLength uint16
+		want    int
+	}{
+		{18, 0, 0},
+		{18, 8, 8},
+		{18, 18, 18},
+		{18, 64, 18},
+		{75, 9, 9},
+		{75, 0xff, 75},
+		{0, 4, 0},
+	}
+	for _, tc := range tests {
+		b := make([]byte, tc.size)
+		if got := truncateControlData(b, tc.wLength); len(got) != tc.want {
+			t.Errorf("truncateControlData(%d bytes, %d) returned %d bytes; want %d", tc.size, tc.wLength, len(got), tc.want)
+		}
+	}
+}
+
+func TestStrToUTF16LEDescriptor(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want []byte
+	}{
+		{"empty", "", []byte{2, 3}},
+		{"ascii", "Go", []byte{6, 3, 'G', 0, 'o', 0}},
+		{"bmp", "é€", []byte{6, 3, 0xe9, 0x00, 0xac, 0x20}},
+		{"surrogate pair", "😀", []byte{6, 3, 0x3d, 0xd8, 0x00, 0xde}},
+	}
+	for _, tc := range tests {
+		b := make([]byte, utf16LEDescriptorSize(tc.in))
+		strToUTF16LEDescriptor(tc.in, b)
+		if string(b) != string(tc.want) {
+			t.Errorf("%s: strToUTF16LEDescriptor(%q) = %x; want %x", tc.name, tc.in, b, tc.want)
+		}
+	}
+}
+
+func TestUTF16LEDescriptorTruncation(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want int
+	}{
+		{"fits", strings.Repeat("a", 126), 254},
+		{"too long", strings.Repeat("a", 200), 254},
+		{"surrogate pair fits", strings.Repeat("a", 124) + "😀", 254},
+		{"surrogate pair does not fit", strings.Repeat("a", 125) + "😀", 252},
+		{"after surrogate pair", strings.Repeat("a", 125) + "😀b", 252},
+	}
+	for _, tc := range tests {
+		size := utf16LEDescriptorSize(tc.in)
+		if size != tc.want {
+			t.Errorf("%s: utf16LEDescriptorSize() = %d; want %d", tc.name, size, tc.want)
+		}
+		b := make([]byte, size)
+		strToUTF16LEDescriptor(tc.in, b)
+		if int(b[0]) != size {
+			t.Errorf("%s: bLength = %d; want %d", tc.name, b[0], size)
+		}
+		// the descriptor must never end in a high surrogate
+		if size > 2 && b[size-1]&0xfc == 0xd8 {
+			t.Errorf("%s: descriptor ends in a high surrogate", tc.name)
+		}
+	}
+}
+
+func TestLookupUSBString(t *testing.T) {
+	def := usbLanguage{
+		langID:       usb_LANGID_DEFAULT,
+		manufacturer: "Maker",
+		product:      "Board",
+		extra:        map[uint8]string{4: "Extra"},
+	}
+	languages := []usbLanguage{
+		{langID: 0x0407, product: "Platine", extra: map[uint8]string{5: "Nur Deutsch"}},
+	}
+	tests := []struct {
+		name   string
+		index  uint8
+		langID uint16
+		want   string
+		wantOK bool
+	}{
+		{"product", usb_IPRODUCT, usb_LANGID_DEFAULT, "Board", true},
+		{"manufacturer", usb_IMANUFACTURER, usb_LANGID_DEFAULT, "Maker", true},
+		{"language 0", usb_IPRODUCT, 0, "Board", true},
+		{"no serial number", usb_ISERIAL, usb_LANGID_DEFAULT, "", false},
+		{"extra string", 4, usb_LANGID_DEFAULT, "Extra", true},
+		{"unknown index", 6, usb_LANGID_DEFAULT, "", false},
+		{"highest index", 0xff, usb_LANGID_DEFAULT, "", false},
+		{"translated", usb_IPRODUCT, 0x0407, "Platine", true},
+		{"fallback to default", usb_IMANUFACTURER, 0x0407, "Maker", true},
+		{"extra fallback to default", 4, 0x0407, "Extra", true},
+		{"extra only translated", 5, 0x0407, "Nur Deutsch", true},
+		{"extra only translated, default", 5, usb_LANGID_DEFAULT, "", false},
+		{"unknown language", usb_IPRODUCT, 0x040c, "", false},
+		{"highest language", usb_IPRODUCT, 0xffff, "", false},
+	}
+	for _, tc := range tests {
+		got, ok := lookupUSBString(def, languages, tc.index, tc.langID)
+		if got != tc.want || ok != tc.wantOK {
+			t.Errorf("%s: lookupUSBString(%d, %#04x) = %q, %v; want %q, %v", tc.name, tc.index, tc.langID, got, ok, tc.want, tc.wantOK)
+		}
+	}
+}
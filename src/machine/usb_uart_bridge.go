@@ -0,0 +1,149 @@
+//go:build sam || nrf52840
+// +build sam nrf52840
+
+package machine
+
+// USBUARTBridge connects the USB-CDC interface to a hardware UART, turning the
+// board into a USB to serial adapter. Data is forwarded in both directions,
+// the baud rate set by the host is applied to the UART, and the modem control
+// and status lines are mirrored on optional pins. All modem lines are active
+// low, like they are on a regular USB to serial adapter.
+//
+// Received bytes that are lost are reported to the host as an overrun: bytes
+// the UART receive buffer had no room for, and bytes received while the host
+// does not have the port open or stops reading. Those are dropped, and the
+// overrun is reported once the port is open again.
+//
+// The bridge is simpler than a real adapter. Only the baud rate of the line
+// coding is applied, the UART keeps its data bits, parity and stop bits.
+// Framing errors, parity errors and breaks are not detected, so they are
+// never reported to the host, and a break requested by the host is not sent.
+// DTR and RTS are only mirrored on pins, the UART itself does no hardware flow
+// control.
+//
+// A minimal adapter looks like this:
+//
+//	bridge := machine.NewUSBUARTBridge(machine.UART1)
+//	bridge.DTR = machine.D5
+//	bridge.Configure()
+//	for {
+//		bridge.Poll()
+//		time.Sleep(time.Millisecond)
+//	}
+type USBUARTBridge struct {
+	UART *UART
+
+	// Outputs, controlled by the host.
+	DTR Pin
+	RTS Pin
+
+	// Inputs, reported to the host.
+	DCD Pin
+	DSR Pin
+	RI  Pin
+
+	baudRate    uint32
+	serialState uint16
+	portOpen    bool
+	overrun     bool  // received bytes were lost since the last notification
+	uartDropped uint8 // last seen drop count of the UART receive buffer
+}
+
+// NewUSBUARTBridge returns a new USBUARTBridge for the given UART, with all
+// modem lines set to NoPin.
+func NewUSBUARTBridge(uart *UART) *USBUARTBridge {
+	return &USBUARTBridge{
+		UART: uart,
+		DTR:  NoPin,
+		RTS:  NoPin,
+		DCD:  NoPin,
+		DSR:  NoPin,
+		RI:   NoPin,
+	}
+}
+
+// Configure configures the modem line pins. The UART and the USB-CDC interface
+// must be configured separately.
+func (b *USBUARTBridge) Configure() {
+	for _, pin := range []Pin{b.DTR, b.RTS} {
+		if pin != NoPin {
+			pin.Configure(PinConfig{Mode: PinOutput})
+			pin.High()
+		}
+	}
+	for _, pin := range []Pin{b.DCD, b.DSR, b.RI} {
+		if pin != NoPin {
+			pin.Configure(PinConfig{Mode: PinInputPullup})
+		}
+	}
+}
+
+// Poll forwards all data that is currently buffered on either side and updates
+// the line coding and modem lines. It must be called regularly.
+//
+// Data from the host is only read from USB as fast as the UART can send it,
+// the host is held off by the USB-CDC flow control in the meantime.
+func (b *USBUARTBridge) Poll() {
+	// Apply line coding changes made by the host.
+	if rate := usbLineInfo.dwDTERate; rate != 0 && rate != b.baudRate {
+		b.UART.SetBaudRate(rate)
+		b.baudRate = rate
+	}
+
+	// Modem control lines, from the host.
+	if b.DTR != NoPin {
+		b.DTR.Set(!USB.DTR())
+	}
+	if b.RTS != NoPin {
+		b.RTS.Set(!USB.RTS())
+	}
+
+	// Data. Bytes from the UART are dropped while the port is closed, the
+	// host would not read them anyway.
+	open := usbLineInfo.lineState != 0
+	for USB.Buffered() > 0 {
+		c, _ := USB.ReadByte()
+		b.UART.WriteByte(c)
+	}
+	for b.UART.Buffered() > 0 {
+		c, _ := b.UART.ReadByte()
+		if !open {
+			b.overrun = true
+			continue
+		}
+		USB.WriteByte(c)
+		if usbLineInfo.lineState == 0 {
+			// WriteByte gave up on the host and dropped the byte
+			b.overrun = true
+			open = false
+		}
+	}
+	if dropped := b.UART.Buffer.dropped.Get(); dropped != b.uartDropped {
+		b.uartDropped = dropped
+		b.overrun = true
+	}
+
+	// Modem status lines, to the host. The state is sent again whenever the
+	// port is opened, as notifications are not sent while it is closed. An
+	// overrun is an event: it is sent once, and the next call sends the state
+	// again without it.
+	var state uint16
+	if b.DCD != NoPin && !b.DCD.Get() {
+		state |= USBCDCSerialStateDCD
+	}
+	if b.DSR != NoPin && !b.DSR.Get() {
+		state |= USBCDCSerialStateDSR
+	}
+	if b.RI != NoPin && !b.RI.Get() {
+		state |= USBCDCSerialStateRI
+	}
+	if open && b.overrun {
+		state |= USBCDCSerialStateOverrun
+		b.overrun = false
+	}
+	if open && (state != b.serialState || !b.portOpen) {
+		USB.SetSerialState(state)
+	}
+	b.serialState = state
+	b.portOpen = open
+}